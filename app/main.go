@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -13,6 +15,9 @@ import (
 // Usage: go run app/main.go -port 8081
 // Example CURL: curl -d '{"game":"Mobile Legends", "gamerID":"GYUTDTE", "points":20}' -H "Content-Type: application/json" -X POST http://localhost:8081/echo
 
+// maxBodyBytes limits the size of the JSON body handleEcho reads
+var maxBodyBytes int64
+
 // handleEcho simply echo back the JSON body it received
 func handleEcho(w http.ResponseWriter, r *http.Request) {
 	// log.Printf("Sleep for 500 us\n")
@@ -25,7 +30,17 @@ func handleEcho(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	raw, _ := io.ReadAll(r.Body)
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		log.Printf("failed to read body with error: %s\n", err.Error())
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, "%s", raw)
 	log.Printf("Handle request: %s%s\n", r.Host, r.RequestURI)
@@ -35,6 +50,7 @@ func handleEcho(w http.ResponseWriter, r *http.Request) {
 func main() {
 	var flagPort int
 	flag.IntVar(&flagPort, "port", 8081, "port to listen (default:8081)")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", 1<<20, "max size of the request body (default:1MB)")
 	flag.Parse()
 
 	// start mux server and serve the JSON echo back API (/echo)
@@ -42,8 +58,12 @@ func main() {
 	r.HandleFunc("/echo", handleEcho).Methods("POST")
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", flagPort),
-		Handler: r,
+		Addr:              fmt.Sprintf(":%d", flagPort),
+		Handler:           r,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
 	}
 	log.Printf("listen on: %s\n", srv.Addr)
 	srv.ListenAndServe()
@@ -0,0 +1,221 @@
+package admin
+
+import (
+	"app/loadbalancer/balancer"
+	"app/loadbalancer/canary"
+	"app/loadbalancer/split"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Pool defines what the admin API needs from a balancer
+type Pool interface {
+	// Stats returns a snapshot of the pool state
+	Stats() balancer.PoolStats
+	// SetDraining drains the instance with the url or puts it back in rotation
+	SetDraining(url string, draining bool) error
+}
+
+// Split defines what the admin API needs from a traffic split
+type Split interface {
+	// Stats returns the weight and the requests of every variant
+	Stats() map[string]split.VariantStats
+	// SetWeights changes the weights of the named variants
+	SetWeights(weights map[string]float64) error
+}
+
+// Canary defines what the admin API needs from a canary analysis
+type Canary interface {
+	// Status returns the canary share and the audit log of the decisions
+	Status() canary.Status
+}
+
+// weightsRequest is the body of the split endpoint
+type weightsRequest struct {
+	Weights map[string]float64 `json:"weights"`
+}
+
+// drainRequest is the body of the drain endpoint
+type drainRequest struct {
+	URL      string `json:"url"`
+	Draining bool   `json:"draining"`
+}
+
+// Server serves the admin API of the load balancer
+type Server struct {
+	pools    map[string]Pool
+	splits   map[string]Split
+	canaries map[string]Canary
+	// token is required as a bearer token by the endpoints changing the state, none if empty
+	token   string
+	handler http.Handler
+}
+
+// Option configures the admin API server
+type Option func(*Server)
+
+// WithToken requires the token as "Authorization: Bearer <token>" on the endpoints draining instances
+// and changing the split weights
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// NewServer new an admin API server for the pools, the traffic splits and the canary analyses keyed by their names
+func NewServer(pools map[string]Pool, splits map[string]Split, canaries map[string]Canary, opts ...Option) *Server {
+	s := &Server{pools: pools, splits: splits, canaries: canaries}
+	for _, opt := range opts {
+		opt(s)
+	}
+	r := mux.NewRouter()
+	r.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	r.HandleFunc("/pools", s.handleListPools).Methods("GET")
+	r.HandleFunc("/pools/{pool}", s.handleGetPool).Methods("GET")
+	r.HandleFunc("/pools/{pool}/drain", s.authorize(s.handleDrain)).Methods("POST")
+	r.HandleFunc("/splits", s.handleListSplits).Methods("GET")
+	r.HandleFunc("/splits/{split}", s.handleGetSplit).Methods("GET")
+	r.HandleFunc("/splits/{split}", s.authorize(s.handleSetWeights)).Methods("PUT")
+	r.HandleFunc("/canaries", s.handleListCanaries).Methods("GET")
+	r.HandleFunc("/canaries/{canary}", s.handleGetCanary).Methods("GET")
+	s.handler = r
+	return s
+}
+
+// ServeHTTP implements the http.Handler interface
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// authorize rejects the requests without the bearer token with 401 when the server has a token
+func (s *Server) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			auth := r.Header.Get("Authorization")
+			if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// handleListPools responds the stats of all pools keyed by their names
+func (s *Server) handleListPools(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]balancer.PoolStats{}
+	for name, pool := range s.pools {
+		stats[name] = pool.Stats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleGetPool responds the stats of a pool, including the circuit state of its instances
+func (s *Server) handleGetPool(w http.ResponseWriter, r *http.Request) {
+	pool, ok := s.pools[mux.Vars(r)["pool"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, pool.Stats())
+}
+
+// handleDrain drains an instance of a pool or puts it back in rotation, and responds the pool stats
+// so the in-flight requests left on the instance can be watched
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	pool, ok := s.pools[mux.Vars(r)["pool"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	req := drainRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+		http.Error(w, "the body must be {\"url\": \"...\", \"draining\": true|false}", http.StatusBadRequest)
+		return
+	}
+	if err := pool.SetDraining(req.URL, req.Draining); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, pool.Stats())
+}
+
+// handleListSplits responds the variant stats of all splits keyed by their names
+func (s *Server) handleListSplits(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]map[string]split.VariantStats{}
+	for name, sp := range s.splits {
+		stats[name] = sp.Stats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleGetSplit responds the weight and the requests of every variant of a split
+func (s *Server) handleGetSplit(w http.ResponseWriter, r *http.Request) {
+	sp, ok := s.splits[mux.Vars(r)["split"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, sp.Stats())
+}
+
+// handleSetWeights changes the weights of the variants of a split, and responds the variant stats.
+// The weights of a split under a running canary analysis are rejected with 409, the analysis would overwrite them.
+func (s *Server) handleSetWeights(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["split"]
+	sp, ok := s.splits[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if c, ok := s.canaries[name]; ok && !c.Status().Done {
+		http.Error(w, "the canary analysis of split "+name+" is running, wait for it to complete or roll back", http.StatusConflict)
+		return
+	}
+	req := weightsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Weights) == 0 {
+		http.Error(w, "the body must be {\"weights\": {\"<variant>\": <weight>}}", http.StatusBadRequest)
+		return
+	}
+	if err := sp.SetWeights(req.Weights); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, sp.Stats())
+}
+
+// handleListCanaries responds the status of all canary analyses keyed by their names
+func (s *Server) handleListCanaries(w http.ResponseWriter, r *http.Request) {
+	status := map[string]canary.Status{}
+	for name, c := range s.canaries {
+		status[name] = c.Status()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleGetCanary responds the canary share and the audit log of a canary analysis
+func (s *Server) handleGetCanary(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.canaries[mux.Vars(r)["canary"]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Status())
+}
+
+// writeJSON writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write admin response with error: %s\n", err.Error())
+	}
+}
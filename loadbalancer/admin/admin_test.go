@@ -0,0 +1,353 @@
+package admin
+
+import (
+	"app/loadbalancer/balancer"
+	"app/loadbalancer/canary"
+	"app/loadbalancer/split"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePool returns fixed stats and records the drained instances
+type fakePool struct {
+	stats    balancer.PoolStats
+	draining map[string]bool
+}
+
+func (p *fakePool) Stats() balancer.PoolStats { return p.stats }
+
+func (p *fakePool) SetDraining(url string, draining bool) error {
+	for _, instance := range p.stats.Instances {
+		if instance.URL == url {
+			p.draining[url] = draining
+			return nil
+		}
+	}
+	return errors.New("instance not found")
+}
+
+func TestServerGetPool(t *testing.T) {
+	t.Parallel()
+
+	pool := &fakePool{stats: balancer.PoolStats{
+		Instances: []balancer.InstanceStats{
+			{
+				URL:     "http://localhost:8081",
+				Alive:   true,
+				Circuit: &balancer.CircuitStats{State: balancer.CircuitOpen, Trips: 1},
+			},
+		},
+	}}
+	s := NewServer(map[string]Pool{"default": pool}, nil, nil)
+
+	tests := []struct {
+		name    string
+		path    string
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "existing pool",
+			path:    "/pools/default",
+			expCode: http.StatusOK,
+			expBody: `"state":"open"`,
+		},
+		{
+			name:    "unknown pool",
+			path:    "/pools/canary",
+			expCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.expCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expBody)
+		})
+	}
+}
+
+func TestServerListPools(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer(map[string]Pool{
+		"default": &fakePool{},
+		"canary":  &fakePool{},
+	}, nil, nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pools", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats := map[string]balancer.PoolStats{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Len(t, stats, 2)
+}
+
+func TestServerDrain(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		path        string
+		body        string
+		expCode     int
+		expDraining map[string]bool
+	}{
+		{
+			name:        "drain instance",
+			path:        "/pools/default/drain",
+			body:        `{"url": "http://localhost:8081", "draining": true}`,
+			expCode:     http.StatusOK,
+			expDraining: map[string]bool{"http://localhost:8081": true},
+		},
+		{
+			name:        "undrain instance",
+			path:        "/pools/default/drain",
+			body:        `{"url": "http://localhost:8081", "draining": false}`,
+			expCode:     http.StatusOK,
+			expDraining: map[string]bool{"http://localhost:8081": false},
+		},
+		{
+			name:        "unknown instance",
+			path:        "/pools/default/drain",
+			body:        `{"url": "http://localhost:8089", "draining": true}`,
+			expCode:     http.StatusNotFound,
+			expDraining: map[string]bool{},
+		},
+		{
+			name:        "malformed body",
+			path:        "/pools/default/drain",
+			body:        `{"url":`,
+			expCode:     http.StatusBadRequest,
+			expDraining: map[string]bool{},
+		},
+		{
+			name:        "unknown pool",
+			path:        "/pools/canary/drain",
+			body:        `{"url": "http://localhost:8081", "draining": true}`,
+			expCode:     http.StatusNotFound,
+			expDraining: map[string]bool{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &fakePool{
+				stats:    balancer.PoolStats{Instances: []balancer.InstanceStats{{URL: "http://localhost:8081"}}},
+				draining: map[string]bool{},
+			}
+			s := NewServer(map[string]Pool{"default": pool}, nil, nil)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.expCode, w.Code)
+			assert.Equal(t, tt.expDraining, pool.draining)
+		})
+	}
+}
+
+func TestServerToken(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		expCode       int
+	}{
+		{
+			name:          "drain with token",
+			method:        http.MethodPost,
+			path:          "/pools/default/drain",
+			authorization: "Bearer s3cret",
+			expCode:       http.StatusOK,
+		},
+		{
+			name:    "drain without token",
+			method:  http.MethodPost,
+			path:    "/pools/default/drain",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:          "drain with wrong token",
+			method:        http.MethodPost,
+			path:          "/pools/default/drain",
+			authorization: "Bearer s3cre",
+			expCode:       http.StatusUnauthorized,
+		},
+		{
+			name:          "set weights with basic auth",
+			method:        http.MethodPut,
+			path:          "/splits/echo",
+			authorization: "Basic czNjcmV0",
+			expCode:       http.StatusUnauthorized,
+		},
+		{
+			name:    "read without token",
+			method:  http.MethodGet,
+			path:    "/pools/default",
+			expCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &fakePool{
+				stats:    balancer.PoolStats{Instances: []balancer.InstanceStats{{URL: "http://localhost:8081"}}},
+				draining: map[string]bool{},
+			}
+			s := NewServer(map[string]Pool{"default": pool}, nil, nil, WithToken("s3cret"))
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"url": "http://localhost:8081", "draining": true}`))
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			assert.Equal(t, tt.expCode, w.Code)
+		})
+	}
+}
+
+func TestServerSetWeights(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		canary     *canary.Status
+		expCode    int
+		expWeights map[string]float64
+	}{
+		{
+			name:       "raise canary",
+			path:       "/splits/echo",
+			body:       `{"weights": {"stable": 90, "canary": 10}}`,
+			expCode:    http.StatusOK,
+			expWeights: map[string]float64{"stable": 90, "canary": 10},
+		},
+		{
+			name:       "invalid weights",
+			path:       "/splits/echo",
+			body:       `{"weights": {"blue": 10}}`,
+			expCode:    http.StatusBadRequest,
+			expWeights: map[string]float64{"stable": 100, "canary": 0},
+		},
+		{
+			name:       "malformed body",
+			path:       "/splits/echo",
+			body:       `{"weights":`,
+			expCode:    http.StatusBadRequest,
+			expWeights: map[string]float64{"stable": 100, "canary": 0},
+		},
+		{
+			name:       "canary analysis running",
+			path:       "/splits/echo",
+			body:       `{"weights": {"stable": 90, "canary": 10}}`,
+			canary:     &canary.Status{Weight: 0},
+			expCode:    http.StatusConflict,
+			expWeights: map[string]float64{"stable": 100, "canary": 0},
+		},
+		{
+			name:       "canary analysis done",
+			path:       "/splits/echo",
+			body:       `{"weights": {"stable": 90, "canary": 10}}`,
+			canary:     &canary.Status{Weight: 0, Done: true},
+			expCode:    http.StatusOK,
+			expWeights: map[string]float64{"stable": 90, "canary": 10},
+		},
+		{
+			name:       "unknown split",
+			path:       "/splits/game",
+			body:       `{"weights": {"canary": 10}}`,
+			expCode:    http.StatusNotFound,
+			expWeights: map[string]float64{"stable": 100, "canary": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp, err := split.NewSplitter("admin-"+tt.name, []split.Variant{
+				{Name: "stable", Weight: 100},
+				{Name: "canary", Weight: 0},
+			}, split.Options{})
+			assert.NoError(t, err)
+			canaries := map[string]Canary{}
+			if tt.canary != nil {
+				canaries["echo"] = &fakeCanary{status: *tt.canary}
+			}
+			s := NewServer(nil, map[string]Split{"echo": sp}, canaries)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.expCode, w.Code)
+			for name, weight := range tt.expWeights {
+				assert.Equal(t, weight, sp.Stats()[name].Weight)
+			}
+
+			w = httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/splits", nil))
+			stats := map[string]map[string]split.VariantStats{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+			assert.Len(t, stats["echo"], 2)
+		})
+	}
+}
+
+// fakeCanary returns a fixed status
+type fakeCanary struct {
+	status canary.Status
+}
+
+func (c *fakeCanary) Status() canary.Status { return c.status }
+
+func TestServerGetCanary(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer(nil, nil, map[string]Canary{"echo": &fakeCanary{status: canary.Status{
+		Weight:    0,
+		Done:      true,
+		Decisions: []canary.Decision{{Action: canary.ActionRollback, Reason: "canary p99 exceeds baseline p99"}},
+	}}})
+
+	tests := []struct {
+		name    string
+		path    string
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "existing canary",
+			path:    "/canaries/echo",
+			expCode: http.StatusOK,
+			expBody: `"action":"rollback"`,
+		},
+		{
+			name:    "all canaries",
+			path:    "/canaries",
+			expCode: http.StatusOK,
+			expBody: `"echo":`,
+		},
+		{
+			name:    "unknown canary",
+			path:    "/canaries/game",
+			expCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.expCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expBody)
+		})
+	}
+}
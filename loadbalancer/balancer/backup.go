@@ -0,0 +1,49 @@
+package balancer
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// failover tracks whether the backup instances take traffic, which is when fewer than threshold primaries are available
+type failover struct {
+	name      string
+	threshold int
+	// active is 1 while the backups take traffic
+	active int32
+}
+
+// newFailover returns the failover of a pool, nil if the pool has no backup instances
+func newFailover(o *options, hasBackups bool) *failover {
+	if !hasBackups {
+		return nil
+	}
+	threshold := o.failoverThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &failover{name: o.name, threshold: threshold}
+}
+
+// update returns whether the backups take traffic with the number of available primaries,
+// logging the failover and failback of the pool
+func (f *failover) update(availablePrimaries int) bool {
+	if f == nil {
+		return false
+	}
+	if availablePrimaries < f.threshold {
+		if atomic.CompareAndSwapInt32(&f.active, 0, 1) {
+			log.Printf("pool %s failed over to its backup instances, %d primaries available", f.name, availablePrimaries)
+		}
+		return true
+	}
+	if atomic.CompareAndSwapInt32(&f.active, 1, 0) {
+		log.Printf("pool %s failed back to its primary instances, %d primaries available", f.name, availablePrimaries)
+	}
+	return false
+}
+
+// isActive returns whether the backups take traffic since the last update
+func (f *failover) isActive() bool {
+	return f != nil && atomic.LoadInt32(&f.active) == 1
+}
@@ -0,0 +1,96 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundRobinBackup(t *testing.T) {
+	t.Parallel()
+
+	primaries := []string{"http://localhost:8081", "http://localhost:8082"}
+	backup := "http://localhost:8083"
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		deadIdx     []int
+		openIdx     []int
+		expBackup   bool
+		expFailover bool
+	}{
+		{
+			name: "all primaries alive",
+		},
+		{
+			name:    "one primary alive",
+			deadIdx: []int{0},
+		},
+		{
+			name:        "no primary alive",
+			deadIdx:     []int{0, 1},
+			expBackup:   true,
+			expFailover: true,
+		},
+		{
+			name:        "circuits of all primaries open",
+			openIdx:     []int{0, 1},
+			expBackup:   true,
+			expFailover: true,
+		},
+		{
+			name:        "fewer primaries alive than the failover threshold",
+			opts:        []Option{WithFailoverThreshold(2)},
+			deadIdx:     []int{0},
+			expBackup:   true,
+			expFailover: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{
+				WithName("backup"),
+				WithInstanceOptions(backup, InstanceOptions{Backup: true}),
+				WithCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 1, OpenDuration: time.Minute}),
+			}, tt.opts...)
+			rr, err := NewRoundRobin(append(primaries, backup), 5, opts...)
+			assert.NoError(t, err)
+			for _, idx := range tt.deadIdx {
+				rr.instances[idx].SetAlive(false)
+			}
+			for _, idx := range tt.openIdx {
+				generation, err := rr.instances[idx].Acquire()
+				assert.NoError(t, err)
+				rr.instances[idx].Release(generation, false, 0)
+			}
+
+			pickedBackup := false
+			for i := 0; i < 6; i++ {
+				next, generation, err := rr.next()
+				assert.NoError(t, err)
+				rr.instances[next].Release(generation, true, 0)
+				pickedBackup = pickedBackup || rr.instances[next].IsBackup()
+			}
+			assert.Equal(t, tt.expBackup, pickedBackup)
+			assert.Equal(t, tt.expFailover, rr.Stats().Failover)
+		})
+	}
+}
+
+func TestFailoverFailback(t *testing.T) {
+	t.Parallel()
+
+	f := newFailover(&options{name: "backup"}, true)
+	assert.False(t, f.update(1))
+	assert.True(t, f.update(0))
+	assert.True(t, f.isActive())
+	assert.False(t, f.update(2))
+	assert.False(t, f.isActive())
+
+	// pools without backups never fail over
+	assert.Nil(t, newFailover(&options{}, false))
+	assert.False(t, (*failover)(nil).update(0))
+}
@@ -0,0 +1,248 @@
+package balancer
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all requests until the open duration passes
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of trial requests through to decide whether to close or open again
+	CircuitHalfOpen
+)
+
+// String implements fmt.Stringer
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler so the state shows up by name in the metrics
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// circuitBuckets is the number of buckets the rolling window is divided into
+const circuitBuckets = 10
+
+// CircuitBreakerOptions holds the settings of the per instance circuit breakers
+type CircuitBreakerOptions struct {
+	// ConsecutiveFailures trips the circuit after that many failures in a row, 0 disables it
+	ConsecutiveFailures int
+	// ErrorRate trips the circuit when the failure ratio in the rolling window reaches it, 0 disables it
+	ErrorRate float64
+	// MinRequests is the number of requests the rolling window needs before ErrorRate applies
+	MinRequests int
+	// Window is the length of the rolling window
+	Window time.Duration
+	// OpenDuration is how long the circuit stays open before letting trial requests through
+	OpenDuration time.Duration
+	// HalfOpenRequests is the number of trial requests, the circuit closes once all of them succeed
+	HalfOpenRequests int
+}
+
+// CircuitStats is a snapshot of a CircuitBreaker
+type CircuitStats struct {
+	State CircuitState `json:"state"`
+	// Since is the time of the last state change
+	Since time.Time `json:"since"`
+	// Trips counts the transitions to the open state
+	Trips int64 `json:"trips"`
+}
+
+// circuitBucket counts the results in a slice of the rolling window
+type circuitBucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// CircuitBreaker is a closed/open/half-open state machine tracking the results of the requests sent to an instance
+type CircuitBreaker struct {
+	name string
+	opts CircuitBreakerOptions
+	now  func() time.Time
+
+	mu                  sync.Mutex
+	state               CircuitState
+	since               time.Time
+	trips               int64
+	consecutiveFailures int
+	buckets             [circuitBuckets]circuitBucket
+	// generation changes with the state, only the results of the requests allowed in the current one count
+	generation uint64
+	// trial requests let through and succeeded in the half-open state
+	halfOpenRequests  int
+	halfOpenSuccesses int
+}
+
+// NewCircuitBreaker new a closed CircuitBreaker, name is used in the state change logs
+func NewCircuitBreaker(name string, opts CircuitBreakerOptions) *CircuitBreaker {
+	if opts.Window <= 0 {
+		opts.Window = 10 * time.Second
+	}
+	if opts.OpenDuration <= 0 {
+		opts.OpenDuration = 5 * time.Second
+	}
+	if opts.HalfOpenRequests <= 0 {
+		opts.HalfOpenRequests = 1
+	}
+	return &CircuitBreaker{
+		name:  name,
+		opts:  opts,
+		now:   time.Now,
+		since: time.Now(),
+	}
+}
+
+// Allow reports whether a request may be sent now and reserves a trial request in the half-open state.
+// Every allowed request must be followed by a Record call with the returned generation.
+func (cb *CircuitBreaker) Allow() (uint64, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+	if cb.state == CircuitOpen && now.Sub(cb.since) >= cb.opts.OpenDuration {
+		cb.transition(CircuitHalfOpen, now)
+	}
+	switch cb.state {
+	case CircuitOpen:
+		return cb.generation, false
+	case CircuitHalfOpen:
+		if cb.halfOpenRequests >= cb.opts.HalfOpenRequests {
+			return cb.generation, false
+		}
+		cb.halfOpenRequests++
+		return cb.generation, true
+	default:
+		return cb.generation, true
+	}
+}
+
+// IsOpen reports whether the circuit rejects all requests, i.e., it's open and the open duration hasn't passed yet
+func (cb *CircuitBreaker) IsOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state == CircuitOpen && cb.now().Sub(cb.since) < cb.opts.OpenDuration
+}
+
+// Record records the result of a request allowed in the generation and moves the state machine.
+// The results of the requests allowed before the last state change are ignored, e.g., a late success
+// of a request sent before the circuit opened doesn't count as a trial.
+func (cb *CircuitBreaker) Record(generation uint64, success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if generation != cb.generation {
+		return
+	}
+	now := cb.now()
+	switch cb.state {
+	case CircuitHalfOpen:
+		if !success {
+			cb.transition(CircuitOpen, now)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.opts.HalfOpenRequests {
+			cb.transition(CircuitClosed, now)
+		}
+	case CircuitClosed:
+		bucket := cb.bucket(now)
+		if success {
+			bucket.successes++
+			cb.consecutiveFailures = 0
+			return
+		}
+		bucket.failures++
+		cb.consecutiveFailures++
+		if cb.shouldTrip(now) {
+			cb.transition(CircuitOpen, now)
+		}
+	}
+}
+
+// Cancel gives back a request allowed in the generation without a result, e.g., the client went away,
+// so a trial request of the half-open state can be let through again
+func (cb *CircuitBreaker) Cancel(generation uint64) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if generation == cb.generation && cb.state == CircuitHalfOpen && cb.halfOpenRequests > 0 {
+		cb.halfOpenRequests--
+	}
+}
+
+// Stats returns a snapshot of the circuit breaker
+func (cb *CircuitBreaker) Stats() CircuitStats {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return CircuitStats{
+		State: cb.state,
+		Since: cb.since,
+		Trips: cb.trips,
+	}
+}
+
+// shouldTrip checks the consecutive failures and the error rate of the rolling window
+func (cb *CircuitBreaker) shouldTrip(now time.Time) bool {
+	if cb.opts.ConsecutiveFailures > 0 && cb.consecutiveFailures >= cb.opts.ConsecutiveFailures {
+		return true
+	}
+	if cb.opts.ErrorRate <= 0 {
+		return false
+	}
+	successes, failures := 0, 0
+	for _, b := range cb.buckets {
+		if now.Sub(b.start) < cb.opts.Window {
+			successes += b.successes
+			failures += b.failures
+		}
+	}
+	total := successes + failures
+	return total >= cb.opts.MinRequests && float64(failures)/float64(total) >= cb.opts.ErrorRate
+}
+
+// bucket returns the bucket of the rolling window `now` falls into, resetting it if it's stale
+func (cb *CircuitBreaker) bucket(now time.Time) *circuitBucket {
+	width := cb.opts.Window / circuitBuckets
+	if width <= 0 {
+		width = 1
+	}
+	start := now.Truncate(width)
+	b := &cb.buckets[(start.UnixNano()/int64(width))%circuitBuckets]
+	if !b.start.Equal(start) {
+		*b = circuitBucket{start: start}
+	}
+	return b
+}
+
+// transition moves to the new state and resets the counters of the previous one
+func (cb *CircuitBreaker) transition(state CircuitState, now time.Time) {
+	log.Printf("circuit of %s changed from %s to %s\n", cb.name, cb.state, state)
+	cb.state = state
+	cb.since = now
+	cb.generation++
+	cb.consecutiveFailures = 0
+	cb.halfOpenRequests = 0
+	cb.halfOpenSuccesses = 0
+	switch state {
+	case CircuitOpen:
+		cb.trips++
+	case CircuitClosed:
+		cb.buckets = [circuitBuckets]circuitBucket{}
+	}
+}
@@ -0,0 +1,176 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a manually advanced clock for the time based state machines
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestCircuitBreaker(opts CircuitBreakerOptions) (*CircuitBreaker, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cb := NewCircuitBreaker("test", opts)
+	cb.now = clock.Now
+	cb.since = clock.now
+	return cb, clock
+}
+
+func TestCircuitBreakerTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		opts     CircuitBreakerOptions
+		results  []bool
+		expState CircuitState
+	}{
+		{
+			name:     "trip on consecutive failures",
+			opts:     CircuitBreakerOptions{ConsecutiveFailures: 3},
+			results:  []bool{true, false, false, false},
+			expState: CircuitOpen,
+		},
+		{
+			name:     "success resets consecutive failures",
+			opts:     CircuitBreakerOptions{ConsecutiveFailures: 3},
+			results:  []bool{false, false, true, false, false},
+			expState: CircuitClosed,
+		},
+		{
+			name:     "trip on error rate",
+			opts:     CircuitBreakerOptions{ErrorRate: 0.5, MinRequests: 4},
+			results:  []bool{true, false, true, false},
+			expState: CircuitOpen,
+		},
+		{
+			name:     "error rate needs the minimum requests",
+			opts:     CircuitBreakerOptions{ErrorRate: 0.5, MinRequests: 4},
+			results:  []bool{false, false, false},
+			expState: CircuitClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb, _ := newTestCircuitBreaker(tt.opts)
+			for _, success := range tt.results {
+				generation, ok := cb.Allow()
+				assert.True(t, ok)
+				cb.Record(generation, success)
+			}
+			assert.Equal(t, tt.expState, cb.Stats().State)
+		})
+	}
+}
+
+func TestCircuitBreakerRollingWindow(t *testing.T) {
+	t.Parallel()
+
+	cb, clock := newTestCircuitBreaker(CircuitBreakerOptions{ErrorRate: 0.5, MinRequests: 4, Window: 10 * time.Second})
+	for i := 0; i < 3; i++ {
+		record(cb, false)
+	}
+	// the failures fall out of the window
+	clock.Advance(11 * time.Second)
+	for i := 0; i < 3; i++ {
+		record(cb, true)
+	}
+	record(cb, false)
+	assert.Equal(t, CircuitClosed, cb.Stats().State)
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	t.Parallel()
+
+	opts := CircuitBreakerOptions{ConsecutiveFailures: 1, OpenDuration: 5 * time.Second, HalfOpenRequests: 2}
+
+	t.Run("close after the trial requests succeed", func(t *testing.T) {
+		cb, clock := newTestCircuitBreaker(opts)
+		record(cb, false)
+		assert.False(t, allowed(cb))
+
+		clock.Advance(5 * time.Second)
+		first, ok := cb.Allow()
+		assert.True(t, ok)
+		second, ok := cb.Allow()
+		assert.True(t, ok)
+		// no more than HalfOpenRequests trial requests
+		assert.False(t, allowed(cb))
+		assert.Equal(t, CircuitHalfOpen, cb.Stats().State)
+
+		cb.Record(first, true)
+		cb.Record(second, true)
+		assert.Equal(t, CircuitClosed, cb.Stats().State)
+		assert.Equal(t, int64(1), cb.Stats().Trips)
+	})
+
+	t.Run("open again on a failed trial request", func(t *testing.T) {
+		cb, clock := newTestCircuitBreaker(opts)
+		record(cb, false)
+
+		clock.Advance(5 * time.Second)
+		generation, ok := cb.Allow()
+		assert.True(t, ok)
+		cb.Record(generation, false)
+		assert.Equal(t, CircuitOpen, cb.Stats().State)
+		assert.Equal(t, int64(2), cb.Stats().Trips)
+		assert.False(t, allowed(cb))
+	})
+
+	t.Run("canceled trial request is given back", func(t *testing.T) {
+		cb, clock := newTestCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 1, OpenDuration: 5 * time.Second})
+		record(cb, false)
+
+		clock.Advance(5 * time.Second)
+		generation, ok := cb.Allow()
+		assert.True(t, ok)
+		assert.False(t, allowed(cb))
+		cb.Cancel(generation)
+		assert.Equal(t, CircuitHalfOpen, cb.Stats().State)
+		record(cb, true)
+		assert.Equal(t, CircuitClosed, cb.Stats().State)
+	})
+
+	t.Run("late results of the requests sent before the trip are ignored", func(t *testing.T) {
+		cb, clock := newTestCircuitBreaker(opts)
+		late, ok := cb.Allow()
+		assert.True(t, ok)
+		record(cb, false)
+
+		clock.Advance(5 * time.Second)
+		first, ok := cb.Allow()
+		assert.True(t, ok)
+		second, ok := cb.Allow()
+		assert.True(t, ok)
+		cb.Record(late, true)
+		cb.Record(first, true)
+		assert.Equal(t, CircuitHalfOpen, cb.Stats().State)
+		cb.Record(second, true)
+		assert.Equal(t, CircuitClosed, cb.Stats().State)
+
+		// nor once the circuit closed again
+		cb.Record(late, false)
+		assert.Equal(t, CircuitClosed, cb.Stats().State)
+	})
+}
+
+// record allows a request and records its result
+func record(cb *CircuitBreaker, success bool) {
+	generation, _ := cb.Allow()
+	cb.Record(generation, success)
+}
+
+// allowed reports whether a request is allowed, the generation is dropped
+func allowed(cb *CircuitBreaker) bool {
+	_, ok := cb.Allow()
+	return ok
+}
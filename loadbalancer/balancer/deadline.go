@@ -0,0 +1,86 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeader carries the remaining time budget of a request in the gRPC timeout format, e.g., "250m" for 250ms
+const TimeoutHeader = "grpc-timeout"
+
+// timeoutUnits maps the gRPC timeout units to durations, from the coarsest to the finest
+var timeoutUnits = []struct {
+	unit     byte
+	duration time.Duration
+}{
+	{'H', time.Hour},
+	{'M', time.Minute},
+	{'S', time.Second},
+	{'m', time.Millisecond},
+	{'u', time.Microsecond},
+	{'n', time.Nanosecond},
+}
+
+// FormatTimeout encodes a duration in the gRPC timeout format with the finest unit fitting in 8 digits
+func FormatTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	for i := len(timeoutUnits) - 1; i >= 0; i-- {
+		u := timeoutUnits[i]
+		// truncate so the budget is never reported longer than it is
+		value := d / u.duration
+		if value < 100000000 {
+			return strconv.FormatInt(int64(value), 10) + string(u.unit)
+		}
+	}
+	return "99999999H"
+}
+
+// ParseTimeout decodes a duration in the gRPC timeout format, values overflowing a time.Duration are invalid
+func ParseTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, errors.New("invalid timeout: " + s)
+	}
+	value, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New("invalid timeout: " + s)
+	}
+	for _, u := range timeoutUnits {
+		if u.unit == s[len(s)-1] {
+			if value > math.MaxInt64/int64(u.duration) {
+				return 0, errors.New("timeout out of range: " + s)
+			}
+			return time.Duration(value) * u.duration, nil
+		}
+	}
+	return 0, errors.New("invalid timeout unit: " + s)
+}
+
+// clientDeadlineKey is the context key marking a deadline set from the client's budget
+type clientDeadlineKey struct{}
+
+// WithClientDeadline marks the deadline set next on ctx as the client's budget rather than the route's,
+// so the 504 when it passes isn't held against the instance
+func WithClientDeadline(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clientDeadlineKey{}, true)
+}
+
+// isClientDeadline reports whether the deadline of ctx was marked by WithClientDeadline
+func isClientDeadline(ctx context.Context) bool {
+	marked, _ := ctx.Value(clientDeadlineKey{}).(bool)
+	return marked
+}
+
+// propagateDeadline sets the remaining budget of the request context's deadline in the TimeoutHeader
+func propagateDeadline(r *http.Request) {
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		return
+	}
+	r.Header.Set(TimeoutHeader, FormatTimeout(time.Until(deadline)))
+}
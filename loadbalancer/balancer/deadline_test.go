@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		exp     string
+	}{
+		{name: "expired", timeout: -time.Second, exp: "0n"},
+		{name: "nanoseconds", timeout: 1500 * time.Nanosecond, exp: "1500n"},
+		{name: "microseconds truncated", timeout: 250*time.Millisecond + 999*time.Nanosecond, exp: "250000u"},
+		{name: "milliseconds", timeout: 2 * time.Minute, exp: "120000m"},
+		{name: "seconds", timeout: 48 * time.Hour, exp: "172800S"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.exp, FormatTimeout(tt.timeout))
+		})
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		timeout string
+		exp     time.Duration
+		expErr  bool
+	}{
+		{name: "milliseconds", timeout: "250m", exp: 250 * time.Millisecond},
+		{name: "hours", timeout: "1H", exp: time.Hour},
+		{name: "missing unit", timeout: "250", expErr: true},
+		{name: "unknown unit", timeout: "250s", expErr: true},
+		{name: "more than 8 digits", timeout: "123456789m", expErr: true},
+		{name: "negative", timeout: "-1S", expErr: true},
+		{name: "zero", timeout: "0n", exp: 0},
+		{name: "largest hours", timeout: "2562047H", exp: 2562047 * time.Hour},
+		{name: "hours overflowing", timeout: "9999999H", expErr: true},
+		{name: "8 digits of hours overflowing", timeout: "99999999H", expErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout, err := ParseTimeout(tt.timeout)
+			if tt.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.exp, timeout)
+			}
+		})
+	}
+}
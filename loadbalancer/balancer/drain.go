@@ -0,0 +1,141 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DrainHeader is set to "true" by an instance responding 503 to the health check to ask to be drained
+const DrainHeader = "X-Drain"
+
+// errInstanceNotFound is returned by SetDraining when no instance has the url
+var errInstanceNotFound = errors.New("instance not found")
+
+// HealthCheckOptions holds the settings of the HTTP or gRPC health check replacing the TCP probe
+type HealthCheckOptions struct {
+	// Type is HealthCheckHTTP, the default, or HealthCheckGRPC
+	Type string
+	// Path is requested with GET on every instance by the HTTP health check, a 2xx response means alive,
+	// a 503 response with the DrainHeader means alive but draining, anything else means dead
+	Path string
+	// Service is the service name sent in the gRPC health check, empty checks the whole server
+	Service string
+	// Timeout bounds the health check request, default 1s
+	Timeout time.Duration
+}
+
+// timeout returns the timeout of the health check request
+func (h *HealthCheckOptions) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return time.Second
+	}
+	return h.Timeout
+}
+
+// newHealthClient returns the client of the HTTP health check, nil if it's disabled.
+// It shares the TLS config of the upstream transport, but not its connections.
+func (o *options) newHealthClient() *http.Client {
+	if o.healthCheck == nil || o.healthCheck.Type == HealthCheckGRPC {
+		return nil
+	}
+	transport := &http.Transport{DisableKeepAlives: true}
+	if o.tlsConfig != nil {
+		transport.TLSClientConfig = o.tlsConfig.Clone()
+	}
+	return &http.Client{Transport: transport, Timeout: o.healthCheck.timeout()}
+}
+
+// checkHTTP requests the health check path of the instance, recording whether the instance asks to be drained
+func (i *RRInstanceImpl) checkHTTP() bool {
+	u := *i.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(i.healthCheck.Path, "/")
+	u.RawQuery = ""
+	resp, err := i.healthClient.Get(u.String())
+	if err != nil {
+		log.Printf("failed to check health of url:%s with error:%s", i.URL.Host, err.Error())
+		i.setHealthDraining(false)
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable && strings.EqualFold(resp.Header.Get(DrainHeader), "true") {
+		i.setHealthDraining(true)
+		return true
+	}
+	i.setHealthDraining(false)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("health check of url:%s responded %d", i.URL.Host, resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// setHealthDraining sets whether the instance asked to be drained in its health check
+func (i *RRInstanceImpl) setHealthDraining(draining bool) {
+	i.mu.Lock()
+	if draining && !i.healthDraining {
+		log.Printf("instance %s asked to be drained", i.URL.String())
+	}
+	started := draining && !i.adminDraining && !i.healthDraining
+	i.healthDraining = draining
+	i.mu.Unlock()
+	if started {
+		i.upgrades.goAwayAfterGrace(i.IsDraining)
+	}
+}
+
+// IsDraining returns whether the instance is drained by the admin API or by its health check.
+// A draining instance takes no new requests but finishes the ones in flight.
+func (i *RRInstanceImpl) IsDraining() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.adminDraining || i.healthDraining
+}
+
+// SetDraining drains the instance or puts it back in rotation, the drain asked by the health check is kept.
+// The upgraded connections of an instance still draining after the upgrade grace period are closed.
+func (i *RRInstanceImpl) SetDraining(draining bool) {
+	i.mu.Lock()
+	started := draining && !i.adminDraining && !i.healthDraining
+	i.adminDraining = draining
+	i.mu.Unlock()
+	if started {
+		i.upgrades.goAwayAfterGrace(i.IsDraining)
+	}
+}
+
+// shutdownUpgraded waits up to gracePeriod for the upgraded connections of the instances to end, then closes the rest
+func shutdownUpgraded(instances []RRInstance, gracePeriod time.Duration) {
+	deadline := time.Now().Add(gracePeriod)
+	for time.Now().Before(deadline) {
+		upgraded := 0
+		for _, instance := range instances {
+			upgraded += instance.Stats().Upgraded
+		}
+		if upgraded == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, instance := range instances {
+		instance.CloseUpgraded()
+	}
+}
+
+// setDraining sets the admin drain of the instance with the url
+func setDraining(instances []RRInstance, url string, draining bool) error {
+	for _, instance := range instances {
+		if instance.Stats().URL == url {
+			instance.SetDraining(draining)
+			log.Printf("instance %s draining: %t", url, draining)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errInstanceNotFound, url)
+}
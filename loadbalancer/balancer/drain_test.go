@@ -0,0 +1,88 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRRInstanceHTTPHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		expAlive    bool
+		expDraining bool
+	}{
+		{
+			name:     "2xx is alive",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			expAlive: true,
+		},
+		{
+			name: "503 with drain header is alive but draining",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(DrainHeader, "true")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			expAlive:    true,
+			expDraining: true,
+		},
+		{
+			name:     "503 without drain header is dead",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			expAlive: false,
+		},
+		{
+			name:     "500 is dead",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			expAlive: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				tt.handler(w, r)
+			}))
+			defer server.Close()
+
+			instance := &RRInstanceImpl{}
+			o := newOptions([]Option{WithHealthCheck(HealthCheckOptions{Path: "/healthz"})})
+			assert.NoError(t, instance.init(server.URL, o.newTransport(), o))
+			assert.Equal(t, tt.expAlive, instance.CheckAliveness())
+			assert.Equal(t, tt.expDraining, instance.IsDraining())
+			assert.Equal(t, "/healthz", path)
+		})
+	}
+}
+
+func TestRoundRobinSetDraining(t *testing.T) {
+	t.Parallel()
+
+	rr, err := NewRoundRobin([]string{"http://localhost:8081", "http://localhost:8082"}, 5, WithName("drain"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, rr.SetDraining("http://localhost:8081", true))
+	for i := 0; i < 4; i++ {
+		next, generation, err := rr.next()
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1), next)
+		rr.instances[next].Release(generation, true, 0)
+	}
+	assert.True(t, rr.Stats().Instances[0].Draining)
+
+	// the drain asked by the health check stays after the admin drain is lifted
+	rr.instances[0].(*RRInstanceImpl).setHealthDraining(true)
+	assert.NoError(t, rr.SetDraining("http://localhost:8081", false))
+	assert.True(t, rr.instances[0].IsDraining())
+	rr.instances[0].(*RRInstanceImpl).setHealthDraining(false)
+	assert.False(t, rr.instances[0].IsDraining())
+
+	assert.ErrorIs(t, rr.SetDraining("http://localhost:8089", true), errInstanceNotFound)
+}
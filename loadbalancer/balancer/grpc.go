@@ -0,0 +1,56 @@
+package balancer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// health check probe types, see HealthCheckOptions.Type
+const (
+	// HealthCheckHTTP requests the health check path
+	HealthCheckHTTP = "http"
+	// HealthCheckGRPC calls grpc.health.v1.Health/Check
+	HealthCheckGRPC = "grpc"
+)
+
+// newGRPCHealthClient returns the client of the gRPC health check of the instance. The connection is kept
+// between the health checks and redialed at most every second while the instance is down.
+func (i *RRInstanceImpl) newGRPCHealthClient() (healthpb.HealthClient, error) {
+	creds := insecure.NewCredentials()
+	if i.URL.Scheme == "https" {
+		creds = credentials.NewTLS(i.probeTLSConfig())
+	}
+	backoffConfig := backoff.DefaultConfig
+	backoffConfig.MaxDelay = time.Second
+	conn, err := grpc.NewClient(i.Addr(),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoffConfig, MinConnectTimeout: i.healthCheck.timeout()}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return healthpb.NewHealthClient(conn), nil
+}
+
+// checkGRPC calls the standard gRPC health check of the instance, only the SERVING status means alive
+func (i *RRInstanceImpl) checkGRPC() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), i.healthCheck.timeout())
+	defer cancel()
+	resp, err := i.grpcHealth.Check(ctx, &healthpb.HealthCheckRequest{Service: i.healthCheck.Service})
+	if err != nil {
+		log.Printf("failed to check gRPC health of url:%s with error:%s", i.URL.Host, err.Error())
+		return false
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		log.Printf("gRPC health check of url:%s responded %s", i.URL.Host, resp.GetStatus())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestRRInstanceGRPCHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	// an in-process gRPC server implementing grpc.health.v1
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("chat", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closedListener.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		service  string
+		expAlive bool
+	}{
+		{
+			name:     "serving server",
+			url:      "http://" + listener.Addr().String(),
+			expAlive: true,
+		},
+		{
+			name:     "serving service",
+			url:      "http://" + listener.Addr().String(),
+			service:  "echo",
+			expAlive: true,
+		},
+		{
+			name:     "not serving service",
+			url:      "http://" + listener.Addr().String(),
+			service:  "chat",
+			expAlive: false,
+		},
+		{
+			name:     "unknown service",
+			url:      "http://" + listener.Addr().String(),
+			service:  "lobby",
+			expAlive: false,
+		},
+		{
+			name:     "server refusing connections",
+			url:      "http://" + closedListener.Addr().String(),
+			expAlive: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &RRInstanceImpl{}
+			o := newOptions([]Option{WithHealthCheck(HealthCheckOptions{Type: HealthCheckGRPC, Service: tt.service})})
+			assert.NoError(t, instance.init(tt.url, o.newTransport(), o))
+			assert.Equal(t, tt.expAlive, instance.CheckAliveness())
+		})
+	}
+}
+
+func TestNewRoundRobinUnknownHealthCheckType(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewRoundRobin([]string{"http://localhost:8081"}, 5, WithHealthCheck(HealthCheckOptions{Type: "tcp"}))
+	assert.EqualError(t, err, "unknown health check type \"tcp\", should be http or grpc")
+}
@@ -0,0 +1,178 @@
+package balancer
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimitOptions holds the settings of the per instance adaptive concurrency limiters
+type AdaptiveLimitOptions struct {
+	// Algorithm is "aimd" or "gradient", default "gradient"
+	Algorithm string
+	// InitialLimit, MinLimit and MaxLimit bound the allowed in-flight requests, default 20, 1 and 1000
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+
+	// BackoffRatio multiplies the AIMD limit on a drop, default 0.9
+	BackoffRatio float64
+	// LatencyThreshold is the AIMD latency above which a request counts as a drop, default 1s
+	LatencyThreshold time.Duration
+
+	// Tolerance is the gradient ratio of the latency to the no-load latency tolerated before lowering the limit, default 1.5
+	Tolerance float64
+	// Smoothing is the gradient weight of a new limit, default 0.2
+	Smoothing float64
+}
+
+// LimitStats is a snapshot of an adaptive concurrency limiter
+type LimitStats struct {
+	Limit int `json:"limit"`
+	// Shed counts the requests rejected for being over the limit
+	Shed int64 `json:"shed"`
+}
+
+// limitAlgorithm computes the next limit from a request sample
+type limitAlgorithm interface {
+	// update returns the new limit given the current one, the sample's latency and in-flight count, and whether it failed
+	update(limit float64, latency time.Duration, inFlight int64, dropped bool) float64
+}
+
+// AdaptiveLimiter adjusts the allowed in-flight requests of an instance based on the observed latency
+type AdaptiveLimiter struct {
+	opts      AdaptiveLimitOptions
+	algorithm limitAlgorithm
+
+	mu    sync.Mutex
+	limit float64
+	shed  int64
+}
+
+// NewAdaptiveLimiter new an AdaptiveLimiter starting at the initial limit
+func NewAdaptiveLimiter(opts AdaptiveLimitOptions) (*AdaptiveLimiter, error) {
+	if opts.InitialLimit <= 0 {
+		opts.InitialLimit = 20
+	}
+	if opts.MinLimit <= 0 {
+		opts.MinLimit = 1
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = 1000
+	}
+	var algorithm limitAlgorithm
+	switch opts.Algorithm {
+	case "aimd":
+		a := &aimdLimit{backoffRatio: opts.BackoffRatio, latencyThreshold: opts.LatencyThreshold}
+		if a.backoffRatio <= 0 || a.backoffRatio >= 1 {
+			a.backoffRatio = 0.9
+		}
+		if a.latencyThreshold <= 0 {
+			a.latencyThreshold = time.Second
+		}
+		algorithm = a
+	case "gradient", "":
+		g := &gradientLimit{tolerance: opts.Tolerance, smoothing: opts.Smoothing, probeMultiplier: 30}
+		if g.tolerance < 1 {
+			g.tolerance = 1.5
+		}
+		if g.smoothing <= 0 || g.smoothing > 1 {
+			g.smoothing = 0.2
+		}
+		algorithm = g
+	default:
+		return nil, errors.New("unknown adaptive limit algorithm: " + opts.Algorithm)
+	}
+	return &AdaptiveLimiter{
+		opts:      opts,
+		algorithm: algorithm,
+		limit:     float64(opts.InitialLimit),
+	}, nil
+}
+
+// Limit returns the number of in-flight requests currently allowed
+func (l *AdaptiveLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.limit)
+}
+
+// Shed records a request rejected for being over the limit
+func (l *AdaptiveLimiter) Shed() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shed++
+}
+
+// OnSample updates the limit with the result of a request, inFlight is the in-flight count when it was sent
+func (l *AdaptiveLimiter) OnSample(latency time.Duration, inFlight int64, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := l.algorithm.update(l.limit, latency, inFlight, dropped)
+	l.limit = math.Max(float64(l.opts.MinLimit), math.Min(float64(l.opts.MaxLimit), limit))
+}
+
+// Stats returns a snapshot of the limiter
+func (l *AdaptiveLimiter) Stats() LimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return LimitStats{Limit: int(l.limit), Shed: l.shed}
+}
+
+// aimdLimit increases the limit by one per successful request and multiplies it by backoffRatio on a drop
+type aimdLimit struct {
+	backoffRatio     float64
+	latencyThreshold time.Duration
+}
+
+func (a *aimdLimit) update(limit float64, latency time.Duration, inFlight int64, dropped bool) float64 {
+	if dropped || latency > a.latencyThreshold {
+		return math.Floor(limit * a.backoffRatio)
+	}
+	// only grow when the limit is actually used, otherwise an idle instance's limit grows without bound
+	if float64(inFlight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// gradientLimit follows Netflix concurrency-limits Gradient: the limit is scaled by the ratio of the no-load
+// latency to the latest one, and grows by a queue allowance while the latency stays near the no-load latency.
+// The no-load latency is probed periodically by dropping the limit to the queue allowance, so it follows
+// backends getting permanently slower and doesn't drift up while the backend is overloaded.
+type gradientLimit struct {
+	tolerance       float64
+	smoothing       float64
+	probeMultiplier int
+
+	minLatency        time.Duration
+	samplesUntilProbe int
+}
+
+func (g *gradientLimit) update(limit float64, latency time.Duration, inFlight int64, dropped bool) float64 {
+	queueSize := math.Sqrt(limit)
+	if g.samplesUntilProbe <= 0 {
+		g.samplesUntilProbe = g.probeMultiplier * int(limit)
+	}
+	g.samplesUntilProbe--
+	if g.samplesUntilProbe == 0 {
+		g.minLatency = 0
+		return queueSize
+	}
+
+	if latency > 0 && (g.minLatency == 0 || latency < g.minLatency) {
+		g.minLatency = latency
+	}
+	if dropped {
+		return limit / 2
+	}
+	// don't grow the limit if it isn't used
+	if float64(inFlight) < limit/2 || g.minLatency == 0 {
+		return limit
+	}
+
+	gradient := math.Max(0.5, math.Min(1, g.tolerance*float64(g.minLatency)/float64(latency)))
+	newLimit := limit*gradient + queueSize
+	return limit*(1-g.smoothing) + newLimit*g.smoothing
+}
@@ -0,0 +1,193 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// simulateBackend drives a limiter with a fake backend which handles `capacity` concurrent requests in `baseLatency`,
+// and slows down proportionally to the overload beyond it. `clients` keep sending requests in a closed loop,
+// so one request completes and a new one is sent each step while the requests over the limit are shed.
+// It returns the average limit and backend latency over the second half of the steps.
+func simulateBackend(l *AdaptiveLimiter, capacity, clients int64, baseLatency time.Duration, steps int) (int64, time.Duration) {
+	latencyOf := func(inFlight int64) time.Duration {
+		if inFlight <= capacity {
+			return baseLatency
+		}
+		return baseLatency * time.Duration(inFlight) / time.Duration(capacity)
+	}
+
+	var limitSum int64
+	var latencySum time.Duration
+	for step := 0; step < steps; step++ {
+		inFlight := clients
+		if limit := l.Limit(); inFlight > limit {
+			inFlight = limit
+		}
+		latency := latencyOf(inFlight)
+		l.OnSample(latency, inFlight, false)
+		if step >= steps/2 {
+			limitSum += l.Limit()
+			latencySum += latency
+		}
+	}
+	samples := int64(steps - steps/2)
+	return limitSum / samples, latencySum / time.Duration(samples)
+}
+
+func TestAdaptiveLimiterSimulation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		opts       AdaptiveLimitOptions
+		expMinimum int64
+		expMaximum int64
+	}{
+		{
+			name:       "gradient converges near the backend capacity",
+			opts:       AdaptiveLimitOptions{Algorithm: "gradient", InitialLimit: 10},
+			expMinimum: 40,
+			expMaximum: 100,
+		},
+		{
+			name:       "aimd converges below the latency threshold",
+			opts:       AdaptiveLimitOptions{Algorithm: "aimd", InitialLimit: 10, LatencyThreshold: 20 * time.Millisecond},
+			expMinimum: 40,
+			expMaximum: 100,
+		},
+		{
+			name:       "gradient backs off from a too high initial limit",
+			opts:       AdaptiveLimitOptions{Algorithm: "gradient", InitialLimit: 500},
+			expMinimum: 40,
+			expMaximum: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewAdaptiveLimiter(tt.opts)
+			assert.NoError(t, err)
+			limit, latency := simulateBackend(l, 50, 400, 10*time.Millisecond, 100000)
+			t.Logf("limit: %d, latency: %s", limit, latency)
+			assert.GreaterOrEqual(t, limit, tt.expMinimum)
+			assert.LessOrEqual(t, limit, tt.expMaximum)
+			// the 400 clients would have made the latency 8 times the base latency without a limit
+			assert.Less(t, latency, 25*time.Millisecond)
+		})
+	}
+}
+
+func TestAdaptiveLimiterSlowerBackend(t *testing.T) {
+	t.Parallel()
+
+	l, err := NewAdaptiveLimiter(AdaptiveLimitOptions{Algorithm: "gradient", InitialLimit: 10})
+	assert.NoError(t, err)
+	simulateBackend(l, 50, 400, 10*time.Millisecond, 100000)
+
+	// the backend gets permanently 3 times slower, the probed no-load latency follows it
+	limit, latency := simulateBackend(l, 50, 400, 30*time.Millisecond, 100000)
+	t.Logf("limit: %d, latency: %s", limit, latency)
+	assert.GreaterOrEqual(t, limit, int64(40))
+	assert.LessOrEqual(t, limit, int64(100))
+}
+
+func TestRoundRobinAdaptiveLimitIgnoresClientErrors(t *testing.T) {
+	t.Parallel()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	tests := []struct {
+		name     string
+		ctx      func(ctx context.Context) (context.Context, context.CancelFunc)
+		expLimit int
+	}{
+		{
+			name: "client deadline",
+			ctx: func(ctx context.Context) (context.Context, context.CancelFunc) {
+				return context.WithTimeout(WithClientDeadline(ctx), 10*time.Millisecond)
+			},
+			expLimit: 20,
+		},
+		{
+			name: "client gone away",
+			ctx: func(ctx context.Context) (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(ctx)
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			expLimit: 20,
+		},
+		{
+			name: "route deadline",
+			ctx: func(ctx context.Context) (context.Context, context.CancelFunc) {
+				return context.WithTimeout(ctx, 10*time.Millisecond)
+			},
+			expLimit: 14,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := NewRoundRobin([]string{slow.URL}, 5,
+				WithName("limit-client-errors"),
+				WithAdaptiveLimit(AdaptiveLimitOptions{Algorithm: "aimd", InitialLimit: 20, BackoffRatio: 0.9}))
+			assert.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+				ctx, cancel := tt.ctx(r.Context())
+				rr.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+				cancel()
+			}
+			assert.Equal(t, tt.expLimit, rr.Stats().Instances[0].AdaptiveLimit.Limit)
+		})
+	}
+}
+
+func TestRoundRobinShedOverAdaptiveLimit(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+
+	rr, err := NewRoundRobin([]string{backend.URL}, 5,
+		WithName("shed-test"),
+		WithAdaptiveLimit(AdaptiveLimitOptions{InitialLimit: 1, MaxLimit: 1}),
+		// requests over the adaptive limit are shed instead of waiting in the queue
+		WithQueue(QueueOptions{MaxDepth: 10, Timeout: time.Second}),
+	)
+	assert.NoError(t, err)
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		rr.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	rr.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int64(0), rr.Stats().Queue.Enqueued)
+	assert.Equal(t, int64(1), rr.Stats().Instances[0].AdaptiveLimit.Shed)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+}
@@ -0,0 +1,56 @@
+package balancer
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// LocalityOptions holds the settings of the zone aware routing
+type LocalityOptions struct {
+	// Zone is the zone of the load balancer, the instances in it are preferred
+	Zone string
+	// MinLocalPercent is the share of the local instances in percent that must be available to keep the traffic in the zone,
+	// below it the traffic spills over to all zones, default 70
+	MinLocalPercent float64
+}
+
+// locality tracks whether the traffic is kept in the local zone
+type locality struct {
+	name       string
+	zone       string
+	minPercent float64
+	// spillover is 1 while the traffic spills over to all zones
+	spillover int32
+}
+
+// newLocality returns the locality of a pool, nil if the zone aware routing is disabled
+func newLocality(o *options) *locality {
+	if o.locality == nil || o.locality.Zone == "" {
+		return nil
+	}
+	minPercent := o.locality.MinLocalPercent
+	if minPercent <= 0 {
+		minPercent = 70
+	}
+	return &locality{name: o.name, zone: o.locality.Zone, minPercent: minPercent}
+}
+
+// update returns whether the traffic is kept in the local zone with the number of available and total local instances,
+// logging when the pool starts and stops spilling over to other zones
+func (l *locality) update(available int, total int) bool {
+	if available == 0 || float64(available)*100 < l.minPercent*float64(total) {
+		if atomic.CompareAndSwapInt32(&l.spillover, 0, 1) {
+			log.Printf("pool %s spills over to other zones, %d of %d instances available in zone %s", l.name, available, total, l.zone)
+		}
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&l.spillover, 1, 0) {
+		log.Printf("pool %s keeps traffic in zone %s again, %d of %d instances available", l.name, l.zone, available, total)
+	}
+	return true
+}
+
+// isSpillover returns whether the traffic spills over to other zones since the last update
+func (l *locality) isSpillover() bool {
+	return l != nil && atomic.LoadInt32(&l.spillover) == 1
+}
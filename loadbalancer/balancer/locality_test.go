@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundRobinLocality(t *testing.T) {
+	t.Parallel()
+
+	local := []string{"http://localhost:8081", "http://localhost:8082", "http://localhost:8083", "http://localhost:8084"}
+	remote := "http://localhost:8085"
+
+	tests := []struct {
+		name         string
+		deadIdx      []int
+		openIdx      []int
+		expRemote    bool
+		expSpillover bool
+	}{
+		{
+			name: "all local instances alive",
+		},
+		{
+			name:    "local instances available above the min percent",
+			deadIdx: []int{0},
+		},
+		{
+			name:         "local instances available below the min percent",
+			deadIdx:      []int{0, 1},
+			expRemote:    true,
+			expSpillover: true,
+		},
+		{
+			name:         "no local instance alive",
+			deadIdx:      []int{0, 1, 2, 3},
+			expRemote:    true,
+			expSpillover: true,
+		},
+		{
+			name:         "circuits of all local instances open",
+			openIdx:      []int{0, 1, 2, 3},
+			expRemote:    true,
+			expSpillover: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{
+				WithName("locality"),
+				WithLocality(LocalityOptions{Zone: "a", MinLocalPercent: 70}),
+				WithInstanceOptions(remote, InstanceOptions{Zone: "b"}),
+				WithCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 1, OpenDuration: time.Minute}),
+			}
+			for _, u := range local {
+				opts = append(opts, WithInstanceOptions(u, InstanceOptions{Zone: "a"}))
+			}
+			rr, err := NewRoundRobin(append(local, remote), 5, opts...)
+			assert.NoError(t, err)
+			for _, idx := range tt.deadIdx {
+				rr.instances[idx].SetAlive(false)
+			}
+			for _, idx := range tt.openIdx {
+				generation, err := rr.instances[idx].Acquire()
+				assert.NoError(t, err)
+				rr.instances[idx].Release(generation, false, 0)
+			}
+
+			pickedRemote := false
+			for i := 0; i < 10; i++ {
+				next, generation, err := rr.next()
+				assert.NoError(t, err)
+				rr.instances[next].Release(generation, true, 0)
+				pickedRemote = pickedRemote || rr.instances[next].Zone() == "b"
+			}
+			assert.Equal(t, tt.expRemote, pickedRemote)
+			assert.Equal(t, tt.expSpillover, rr.Stats().ZoneSpillover)
+		})
+	}
+}
+
+func TestSelectionWithBackupsAndLocality(t *testing.T) {
+	t.Parallel()
+
+	instances := []RRInstance{
+		&RRInstanceImpl{alive: false, zone: "a"},
+		&RRInstanceImpl{alive: true, zone: "b", backup: true},
+		&RRInstanceImpl{alive: true, zone: "a", backup: true},
+	}
+	o := &options{locality: &LocalityOptions{Zone: "a", MinLocalPercent: 50}}
+	s := newSelection(len(instances), func(i int) RRInstance { return instances[i] }, newFailover(o, true), newLocality(o))
+
+	// the only primary is dead, so the pool fails over and the local backup keeps the traffic in the zone
+	assert.Equal(t, selection{useBackups: true, zone: "a"}, s)
+	assert.False(t, s.allows(instances[1]))
+	assert.True(t, s.allows(instances[2]))
+}
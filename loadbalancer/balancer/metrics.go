@@ -0,0 +1,50 @@
+package balancer
+
+import (
+	"expvar"
+)
+
+// poolMetrics publishes the PoolStats of every balancer under its pool name at /debug/vars
+var poolMetrics = expvar.NewMap("pools")
+
+// PoolStats is a snapshot of the state of a balancer's pool
+type PoolStats struct {
+	Transport TransportStats  `json:"transport"`
+	Instances []InstanceStats `json:"instances"`
+	// Queue is nil if the wait queue is disabled
+	Queue *QueueStats `json:"queue,omitempty"`
+	// Failover is true while the backup instances take traffic
+	Failover bool `json:"failover"`
+	// ZoneSpillover is true while the traffic spills over from the local zone to all zones
+	ZoneSpillover bool `json:"zoneSpillover"`
+}
+
+// InstanceStats is a snapshot of the state of an instance
+type InstanceStats struct {
+	URL   string `json:"url"`
+	Alive bool   `json:"alive"`
+	// Draining is true while the instance takes no new requests, its in-flight requests are still counted
+	Draining bool `json:"draining"`
+	// Backup instances only take traffic when the pool failed over
+	Backup bool   `json:"backup"`
+	Zone   string `json:"zone,omitempty"`
+	// InFlight is the number of requests currently sent to the instance
+	InFlight int64 `json:"inFlight"`
+	// Upgraded is the number of open upgraded connections, e.g., WebSockets, they're also counted in InFlight
+	Upgraded int `json:"upgraded"`
+	// MaxConnections is the in-flight limit, 0 means unlimited
+	MaxConnections int `json:"maxConnections"`
+	// SlowStartFactor is the effective weight in (0, 1], less than 1 while the instance is slow starting
+	SlowStartFactor float64 `json:"slowStartFactor"`
+	// Circuit is nil if the circuit breaker is disabled
+	Circuit *CircuitStats `json:"circuit,omitempty"`
+	// AdaptiveLimit is nil if the adaptive concurrency limit is disabled
+	AdaptiveLimit *LimitStats `json:"adaptiveLimit,omitempty"`
+}
+
+// publishStats publishes the stats function of a balancer under the pool name, replacing any previous one
+func publishStats(name string, stats func() PoolStats) {
+	poolMetrics.Set(name, expvar.Func(func() interface{} {
+		return stats()
+	}))
+}
@@ -0,0 +1,147 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// Option configures the optional settings of a balancer
+type Option func(*options)
+
+// options holds the pool level settings shared by all instances of a balancer
+type options struct {
+	name             string
+	tlsConfig        *tls.Config
+	transportOptions TransportOptions
+	circuitBreaker   *CircuitBreakerOptions
+	queue            *QueueOptions
+	adaptiveLimit    *AdaptiveLimitOptions
+	slowStart        *SlowStartOptions
+	healthCheck      *HealthCheckOptions
+	// failoverThreshold is the number of available primaries below which the backups take traffic
+	failoverThreshold int
+	locality          *LocalityOptions
+	// healthClient is shared by the HTTP health checks of all instances, see newHealthClient
+	healthClient *http.Client
+	// upgradeGracePeriod is how long the upgraded connections are kept open on drain and shutdown
+	upgradeGracePeriod time.Duration
+	instances          map[string]InstanceOptions
+}
+
+// InstanceOptions holds the settings of a single instance
+type InstanceOptions struct {
+	// MaxConnections is the number of concurrent requests the instance takes, 0 means unlimited
+	MaxConnections int
+	// Backup instances only take traffic when the pool failed over, see WithFailoverThreshold
+	Backup bool
+	// Zone is the zone of the instance, see WithLocality
+	Zone string
+	// Protocol is the upstream protocol of the instance, ProtocolHTTP1, ProtocolH2 or ProtocolH2C,
+	// empty negotiates HTTP/2 over TLS and uses HTTP/1.1 otherwise
+	Protocol string
+}
+
+// WithName sets the pool name the balancer's metrics are published under, default is "default"
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithTLSConfig sets the TLS config used by the upstream transport and the health check probes
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = tlsConfig
+	}
+}
+
+// WithTransportOptions sets the connection pooling and timeout settings of the upstream transport
+func WithTransportOptions(transportOptions TransportOptions) Option {
+	return func(o *options) {
+		o.transportOptions = transportOptions
+	}
+}
+
+// WithCircuitBreaker enables a circuit breaker on every instance of the balancer
+func WithCircuitBreaker(circuitBreakerOptions CircuitBreakerOptions) Option {
+	return func(o *options) {
+		o.circuitBreaker = &circuitBreakerOptions
+	}
+}
+
+// WithQueue lets requests wait in a bounded FIFO queue when all alive instances are busy, instead of failing right away
+func WithQueue(queueOptions QueueOptions) Option {
+	return func(o *options) {
+		o.queue = &queueOptions
+	}
+}
+
+// WithAdaptiveLimit enables an adaptive concurrency limiter on every instance of the balancer,
+// requests over the limit of all alive instances are shed with 503 instead of waiting in the queue
+func WithAdaptiveLimit(adaptiveLimitOptions AdaptiveLimitOptions) Option {
+	return func(o *options) {
+		o.adaptiveLimit = &adaptiveLimitOptions
+	}
+}
+
+// WithSlowStart ramps up the effective weight of the instances becoming alive again over the slow start window
+func WithSlowStart(slowStartOptions SlowStartOptions) Option {
+	return func(o *options) {
+		o.slowStart = &slowStartOptions
+	}
+}
+
+// WithHealthCheck replaces the TCP health check probe with an HTTP request to the health check path,
+// which also lets the instances ask to be drained, or with the standard gRPC health check
+func WithHealthCheck(healthCheckOptions HealthCheckOptions) Option {
+	return func(o *options) {
+		o.healthCheck = &healthCheckOptions
+	}
+}
+
+// WithFailoverThreshold lets the backup instances take traffic along with the primaries
+// when fewer than threshold primaries are alive and not draining, default 1 for when none is
+func WithFailoverThreshold(threshold int) Option {
+	return func(o *options) {
+		o.failoverThreshold = threshold
+	}
+}
+
+// WithLocality prefers the instances in the zone of the load balancer, spilling over to all zones
+// when too few of the local ones are available
+func WithLocality(localityOptions LocalityOptions) Option {
+	return func(o *options) {
+		o.locality = &localityOptions
+	}
+}
+
+// WithUpgradeGracePeriod sets how long the upgraded connections, e.g., WebSockets, of a draining instance
+// or of a pool shutting down are kept open before they're closed, default 30s
+func WithUpgradeGracePeriod(gracePeriod time.Duration) Option {
+	return func(o *options) {
+		o.upgradeGracePeriod = gracePeriod
+	}
+}
+
+// WithInstanceOptions sets the settings of the instance with the url
+func WithInstanceOptions(url string, instanceOptions InstanceOptions) Option {
+	return func(o *options) {
+		o.instances[url] = instanceOptions
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		name:      "default",
+		instances: map[string]InstanceOptions{},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.healthClient = o.newHealthClient()
+	if o.upgradeGracePeriod <= 0 {
+		o.upgradeGracePeriod = defaultUpgradeGracePeriod
+	}
+	return o
+}
@@ -0,0 +1,190 @@
+package balancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// upstream protocols of the instances, see InstanceOptions.Protocol
+const (
+	// ProtocolHTTP1 is HTTP/1.1 over TCP or TLS
+	ProtocolHTTP1 = "http/1.1"
+	// ProtocolH2 is HTTP/2 over TLS, the instance must negotiate it with ALPN
+	ProtocolH2 = "h2"
+	// ProtocolH2C is cleartext HTTP/2 with prior knowledge
+	ProtocolH2C = "h2c"
+)
+
+// protocolTransport sends the requests of the instances with an upstream protocol through its own transport,
+// recorded in the stats of the pool transport
+type protocolTransport struct {
+	*statsTransport
+	transport http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *protocolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.roundTrip(t.transport, r)
+}
+
+// newProtocolTransports builds the transports of the upstream protocols on top of the pool transport,
+// they share its TLS config, timeouts and connection counting dial. The HTTP/2 transports wait for
+// the response headers up to ResponseHeaderTimeout, check the idle connections with pings every KeepAlive
+// and open a single connection per instance when MaxConnsPerHost is set, capped by its max concurrent streams.
+func (t *statsTransport) newProtocolTransports(o *options, dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	http1 := t.transport.Clone()
+	http1.ForceAttemptHTTP2 = false
+	// a non-nil empty map disables HTTP/2 over TLS, and the instances are only offered HTTP/1.1 with ALPN
+	http1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if http1.TLSClientConfig != nil {
+		http1.TLSClientConfig.NextProtos = []string{ProtocolHTTP1}
+	}
+
+	to := o.transportOptions
+	h2 := &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, cfg)
+			handshakeCtx := ctx
+			if timeout := t.transport.TLSHandshakeTimeout; timeout > 0 {
+				var cancel context.CancelFunc
+				handshakeCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if p := tlsConn.ConnectionState().NegotiatedProtocol; p != ProtocolH2 {
+				conn.Close()
+				return nil, fmt.Errorf("the instance %s negotiated %q instead of h2", addr, p)
+			}
+			return tlsConn, nil
+		},
+		DisableCompression:         t.transport.DisableCompression,
+		IdleConnTimeout:            to.IdleConnTimeout,
+		ReadIdleTimeout:            h2ReadIdleTimeout(to.KeepAlive),
+		PingTimeout:                h2PingTimeout,
+		StrictMaxConcurrentStreams: to.MaxConnsPerHost > 0,
+	}
+	if o.tlsConfig != nil {
+		h2.TLSClientConfig = o.tlsConfig.Clone()
+	}
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+		DisableCompression:         t.transport.DisableCompression,
+		IdleConnTimeout:            to.IdleConnTimeout,
+		ReadIdleTimeout:            h2ReadIdleTimeout(to.KeepAlive),
+		PingTimeout:                h2PingTimeout,
+		StrictMaxConcurrentStreams: to.MaxConnsPerHost > 0,
+	}
+
+	t.protocols = map[string]http.RoundTripper{
+		ProtocolHTTP1: &protocolTransport{statsTransport: t, transport: http1},
+		ProtocolH2:    &protocolTransport{statsTransport: t, transport: withHeaderTimeout(h2, to.ResponseHeaderTimeout)},
+		ProtocolH2C:   &protocolTransport{statsTransport: t, transport: withHeaderTimeout(h2c, to.ResponseHeaderTimeout)},
+	}
+}
+
+// h2PingTimeout closes an HTTP/2 connection whose ping isn't answered in time
+const h2PingTimeout = 15 * time.Second
+
+// h2ReadIdleTimeout returns the period of the pings checking an HTTP/2 connection nothing was read from,
+// the TCP keep-alive period, default 30s, and none if TCP keep-alive is disabled
+func h2ReadIdleTimeout(keepAlive time.Duration) time.Duration {
+	switch {
+	case keepAlive < 0:
+		return 0
+	case keepAlive == 0:
+		return 30 * time.Second
+	}
+	return keepAlive
+}
+
+// errResponseHeaderTimeout is returned when an instance doesn't send the response headers in time
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// headerTimeoutTransport cancels the requests whose response headers don't arrive within the timeout,
+// like http.Transport's ResponseHeaderTimeout which http2.Transport doesn't have
+type headerTimeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+// withHeaderTimeout wraps transport with the response header timeout, no timeout if it's not positive
+func withHeaderTimeout(transport http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		return transport
+	}
+	return &headerTimeoutTransport{transport: transport, timeout: timeout}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *headerTimeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+	resp, err := t.transport.RoundTrip(r.WithContext(ctx))
+	if !timer.Stop() {
+		// the timer canceled the request, the error is not the client's cancellation
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the stream is canceled once the body is closed
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the context of its request once closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// forProtocol returns the transport of the upstream protocol of an instance with the scheme,
+// the pool transport negotiating HTTP/2 over TLS if the protocol is empty
+func (t *statsTransport) forProtocol(protocol, scheme string) (http.RoundTripper, error) {
+	switch {
+	case protocol == "":
+		return t, nil
+	case protocol == ProtocolH2 && scheme != "https":
+		return nil, errors.New("the upstream protocol h2 needs an https url")
+	case protocol == ProtocolH2C && scheme != "http":
+		return nil, errors.New("the upstream protocol h2c needs an http url")
+	case (protocol == ProtocolH2 || protocol == ProtocolH2C) && t.transport.DisableKeepAlives:
+		// HTTP/2 multiplexes the requests on kept-alive connections
+		return nil, fmt.Errorf("the upstream protocol %s doesn't support disableKeepAlives", protocol)
+	}
+	transport, ok := t.protocols[protocol]
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream protocol %q, should be one of http/1.1, h2 and h2c", protocol)
+	}
+	return transport, nil
+}
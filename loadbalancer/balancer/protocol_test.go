@@ -0,0 +1,200 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestRoundRobinUpstreamProtocol(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	})
+	h2Server := httptest.NewUnstartedServer(handler)
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+	http1Server := httptest.NewTLSServer(handler)
+	defer http1Server.Close()
+	h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(h2Server.Certificate())
+	roots.AddCert(http1Server.Certificate())
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	tests := []struct {
+		name     string
+		url      string
+		protocol string
+		expCode  int
+		expProto string
+	}{
+		{
+			name:     "negotiate HTTP/2 over TLS by default",
+			url:      h2Server.URL,
+			expCode:  http.StatusOK,
+			expProto: "HTTP/2.0",
+		},
+		{
+			name:     "HTTP/1.1 to an instance supporting HTTP/2",
+			url:      h2Server.URL,
+			protocol: ProtocolHTTP1,
+			expCode:  http.StatusOK,
+			expProto: "HTTP/1.1",
+		},
+		{
+			name:     "h2",
+			url:      h2Server.URL,
+			protocol: ProtocolH2,
+			expCode:  http.StatusOK,
+			expProto: "HTTP/2.0",
+		},
+		{
+			name:     "h2 to an instance without HTTP/2",
+			url:      http1Server.URL,
+			protocol: ProtocolH2,
+			expCode:  http.StatusBadGateway,
+		},
+		{
+			name:     "h2c",
+			url:      h2cServer.URL,
+			protocol: ProtocolH2C,
+			expCode:  http.StatusOK,
+			expProto: "HTTP/2.0",
+		},
+		{
+			name:     "cleartext HTTP/1.1 by default",
+			url:      h2cServer.URL,
+			expCode:  http.StatusOK,
+			expProto: "HTTP/1.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := NewRoundRobin([]string{tt.url}, 5,
+				WithName("protocol"),
+				WithTLSConfig(tlsConfig),
+				WithInstanceOptions(tt.url, InstanceOptions{Protocol: tt.protocol}),
+			)
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			rr.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", nil))
+			assert.Equal(t, tt.expCode, w.Code)
+			assert.Equal(t, tt.expProto, w.Header().Get("X-Proto"))
+		})
+	}
+}
+
+func TestNewRoundRobinInvalidProtocol(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		url              string
+		protocol         string
+		transportOptions TransportOptions
+		expErr           string
+	}{
+		{
+			name:     "h2c to an https url",
+			url:      "https://localhost:8443",
+			protocol: ProtocolH2C,
+			expErr:   "instance https://localhost:8443: the upstream protocol h2c needs an http url",
+		},
+		{
+			name:     "h2 to an http url",
+			url:      "http://localhost:8081",
+			protocol: ProtocolH2,
+			expErr:   "instance http://localhost:8081: the upstream protocol h2 needs an https url",
+		},
+		{
+			name:     "unknown protocol",
+			url:      "http://localhost:8081",
+			protocol: "spdy",
+			expErr:   "instance http://localhost:8081: unknown upstream protocol \"spdy\", should be one of http/1.1, h2 and h2c",
+		},
+		{
+			name:             "h2c without keep-alive",
+			url:              "http://localhost:8081",
+			protocol:         ProtocolH2C,
+			transportOptions: TransportOptions{DisableKeepAlives: true},
+			expErr:           "instance http://localhost:8081: the upstream protocol h2c doesn't support disableKeepAlives",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRoundRobin([]string{tt.url}, 5,
+				WithTransportOptions(tt.transportOptions),
+				WithInstanceOptions(tt.url, InstanceOptions{Protocol: tt.protocol}))
+			assert.EqualError(t, err, tt.expErr)
+		})
+	}
+}
+
+func TestRoundRobinUpstreamProtocolHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}
+	})
+	h2Server := httptest.NewUnstartedServer(handler)
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+	h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(h2Server.Certificate())
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	tests := []struct {
+		name     string
+		url      string
+		protocol string
+		path     string
+		expCode  int
+	}{
+		{name: "h2 headers in time", url: h2Server.URL, protocol: ProtocolH2, path: "/echo", expCode: http.StatusOK},
+		{name: "h2 headers too late", url: h2Server.URL, protocol: ProtocolH2, path: "/slow", expCode: http.StatusBadGateway},
+		{name: "h2c headers in time", url: h2cServer.URL, protocol: ProtocolH2C, path: "/echo", expCode: http.StatusOK},
+		{name: "h2c headers too late", url: h2cServer.URL, protocol: ProtocolH2C, path: "/slow", expCode: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := NewRoundRobin([]string{tt.url}, 5,
+				WithName("protocol-header-timeout"),
+				WithTLSConfig(tlsConfig),
+				WithTransportOptions(TransportOptions{ResponseHeaderTimeout: 100 * time.Millisecond}),
+				WithInstanceOptions(tt.url, InstanceOptions{Protocol: tt.protocol}),
+			)
+			assert.NoError(t, err)
+
+			startTime := time.Now()
+			w := httptest.NewRecorder()
+			rr.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, nil))
+			assert.Equal(t, tt.expCode, w.Code)
+			assert.Less(t, time.Since(startTime), time.Second)
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package balancer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("the wait queue is full")
+	errQueueTimeout = errors.New("timed out in the wait queue")
+)
+
+// QueueOptions holds the settings of the queue requests wait in when all alive instances are busy
+type QueueOptions struct {
+	// MaxDepth is the number of requests allowed to wait, requests beyond it are rejected right away
+	MaxDepth int
+	// Timeout is how long a request waits before it's rejected, it must be positive
+	Timeout time.Duration
+}
+
+// QueueStats is a snapshot of the wait queue
+type QueueStats struct {
+	// Depth is the number of requests currently waiting
+	Depth int `json:"depth"`
+	// Enqueued counts the requests which waited, Timeouts counts the ones which gave up and Rejected the ones which couldn't wait
+	Enqueued int64 `json:"enqueued"`
+	Timeouts int64 `json:"timeouts"`
+	Rejected int64 `json:"rejected"`
+	// TotalWait and MaxWait are the wait time of the requests which left the queue with an instance
+	TotalWait time.Duration `json:"totalWaitNs"`
+	MaxWait   time.Duration `json:"maxWaitNs"`
+}
+
+// waiter is a request waiting in the queue, signaled is set once it's woken up for a released instance
+type waiter struct {
+	ch       chan struct{}
+	signaled bool
+	enqueued time.Time
+}
+
+// waitQueue is a bounded FIFO queue of the requests waiting for a busy instance to be released
+type waitQueue struct {
+	opts QueueOptions
+
+	mu      sync.Mutex
+	waiters list.List
+	stats   QueueStats
+}
+
+func newWaitQueue(opts QueueOptions) *waitQueue {
+	return &waitQueue{opts: opts}
+}
+
+// acquire runs try right away when no request is waiting, and queues the request if all alive instances are busy.
+// Requests arriving while others wait queue behind them, so the instances are handed out in arrival order.
+// A queued request runs try each time it's signaled for a released instance. It fails if the queue is full,
+// the queue timeout passes or ctx is done. try runs under the queue lock, so an instance released while try fails
+// signals the request once it's queued or waiting again.
+func (q *waitQueue) acquire(ctx context.Context, try func() error) error {
+	q.mu.Lock()
+	if q.waiters.Len() == 0 {
+		if err := try(); !errors.Is(err, errInstancesBusy) {
+			q.mu.Unlock()
+			return err
+		}
+	}
+	if q.waiters.Len() >= q.opts.MaxDepth {
+		q.stats.Rejected++
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	start := time.Now()
+	w := &waiter{ch: make(chan struct{}, 1), enqueued: start}
+	elem := q.waiters.PushBack(w)
+	q.stats.Enqueued++
+	if q.waiters.Len() > 1 {
+		// an instance may have become available without being released, e.g., back alive,
+		// so the first waiter not signaled yet retries instead of waiting for the next release
+		q.signalLocked()
+	}
+	q.mu.Unlock()
+
+	timer := time.NewTimer(q.opts.Timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.ch:
+			q.mu.Lock()
+			if try() == nil {
+				q.leaveLocked(elem, true, time.Since(start))
+				q.mu.Unlock()
+				return nil
+			}
+			// another request took the released instance, keep the position and wait for the next one
+			w.signaled = false
+			q.mu.Unlock()
+		case <-timer.C:
+			q.leave(elem)
+			return errQueueTimeout
+		case <-ctx.Done():
+			q.leave(elem)
+			return ctx.Err()
+		}
+	}
+}
+
+// leave removes a waiter giving up from the queue
+func (q *waitQueue) leave(elem *list.Element) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.leaveLocked(elem, false, 0)
+}
+
+// leaveLocked removes the waiter from the queue. A waiter giving up passes the signal it didn't use on to the next waiter.
+func (q *waitQueue) leaveLocked(elem *list.Element, acquired bool, waited time.Duration) {
+	w := q.waiters.Remove(elem).(*waiter)
+	if acquired {
+		q.stats.TotalWait += waited
+		if waited > q.stats.MaxWait {
+			q.stats.MaxWait = waited
+		}
+		return
+	}
+	q.stats.Timeouts++
+	if w.signaled {
+		q.signalLocked()
+	}
+}
+
+// notify wakes up the first waiter not woken yet, it's called when an instance is released
+func (q *waitQueue) notify() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.signalLocked()
+}
+
+func (q *waitQueue) signalLocked() {
+	for elem := q.waiters.Front(); elem != nil; elem = elem.Next() {
+		w := elem.Value.(*waiter)
+		if !w.signaled {
+			w.signaled = true
+			w.ch <- struct{}{}
+			return
+		}
+	}
+}
+
+// oldestWait returns how long the request at the head of the queue has waited, 0 if the queue is empty
+func (q *waitQueue) oldestWait() time.Duration {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	front := q.waiters.Front()
+	if front == nil {
+		return 0
+	}
+	return time.Since(front.Value.(*waiter).enqueued)
+}
+
+// Stats returns a snapshot of the queue
+func (q *waitQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Depth = q.waiters.Len()
+	return stats
+}
@@ -0,0 +1,183 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundRobinQueue(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+
+	rr, err := NewRoundRobin([]string{backend.URL}, 5,
+		WithName("queue-test"),
+		WithInstanceOptions(backend.URL, InstanceOptions{MaxConnections: 1}),
+		WithQueue(QueueOptions{MaxDepth: 1, Timeout: time.Second}),
+	)
+	assert.NoError(t, err)
+
+	codes := make([]int, 2)
+	wg := sync.WaitGroup{}
+	serve := func(idx int) {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		rr.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", nil))
+		codes[idx] = w.Code
+	}
+
+	// the first request holds the only connection and the second waits in the queue
+	wg.Add(2)
+	go serve(0)
+	<-started
+	go serve(1)
+	assert.Eventually(t, func() bool { return rr.Stats().Queue.Depth == 1 }, time.Second, time.Millisecond)
+
+	// the queue is full
+	w := httptest.NewRecorder()
+	rr.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// the queued request gets the instance once the first one is done
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	wg.Wait()
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+
+	stats := rr.Stats().Queue
+	assert.Equal(t, 0, stats.Depth)
+	assert.Equal(t, int64(1), stats.Enqueued)
+	assert.Equal(t, int64(1), stats.Rejected)
+	assert.Greater(t, stats.MaxWait, time.Duration(0))
+}
+
+func TestRoundRobinQueueDeadline(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	tests := []struct {
+		name         string
+		queueTimeout time.Duration
+		deadline     time.Duration
+		expCode      int
+	}{
+		{
+			name:         "deadline passed in the queue",
+			queueTimeout: time.Second,
+			deadline:     50 * time.Millisecond,
+			expCode:      http.StatusGatewayTimeout,
+		},
+		{
+			name:         "queue timeout",
+			queueTimeout: 50 * time.Millisecond,
+			deadline:     time.Second,
+			expCode:      http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := NewRoundRobin([]string{backend.URL}, 5,
+				WithName("queue-deadline-test"),
+				WithInstanceOptions(backend.URL, InstanceOptions{MaxConnections: 1}),
+				WithQueue(QueueOptions{MaxDepth: 1, Timeout: tt.queueTimeout}),
+			)
+			assert.NoError(t, err)
+
+			// the first request holds the only connection until the end of the test
+			go rr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/echo", nil))
+			<-started
+
+			r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+			ctx, cancel := context.WithTimeout(r.Context(), tt.deadline)
+			defer cancel()
+			w := httptest.NewRecorder()
+			rr.ServeHTTP(w, r.WithContext(ctx))
+			assert.Equal(t, tt.expCode, w.Code)
+		})
+	}
+}
+
+func TestWaitQueueTimeout(t *testing.T) {
+	t.Parallel()
+
+	q := newWaitQueue(QueueOptions{MaxDepth: 2, Timeout: 20 * time.Millisecond})
+	r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+
+	// an available instance is acquired right away when no request waits
+	assert.NoError(t, q.acquire(r.Context(), func() error { return nil }))
+	assert.Equal(t, int64(0), q.Stats().Enqueued)
+
+	// a waiter whose try fails keeps waiting until the timeout
+	done := make(chan error)
+	go func() { done <- q.acquire(r.Context(), func() error { return errInstancesBusy }) }()
+	assert.Eventually(t, func() bool { return q.Stats().Depth == 1 }, time.Second, time.Millisecond)
+	q.notify()
+	assert.ErrorIs(t, <-done, errQueueTimeout)
+	assert.Equal(t, int64(1), q.Stats().Timeouts)
+}
+
+func TestWaitQueueFIFO(t *testing.T) {
+	t.Parallel()
+
+	q := newWaitQueue(QueueOptions{MaxDepth: 2, Timeout: time.Second})
+	r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+
+	var mu sync.Mutex
+	free := 0
+	order := []int{}
+	try := func(idx int) func() error {
+		return func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			if free == 0 {
+				return errInstancesBusy
+			}
+			free--
+			order = append(order, idx)
+			return nil
+		}
+	}
+
+	done := make(chan error, 2)
+	go func() { done <- q.acquire(r.Context(), try(0)) }()
+	assert.Eventually(t, func() bool { return q.Stats().Depth == 1 }, time.Second, time.Millisecond)
+
+	// an instance becoming available without a release doesn't let a new arrival jump the queue
+	mu.Lock()
+	free = 1
+	mu.Unlock()
+	go func() { done <- q.acquire(r.Context(), try(1)) }()
+	assert.NoError(t, <-done)
+	assert.Equal(t, []int{0}, order)
+
+	// the instance released right after the waiter's try failed is not lost
+	mu.Lock()
+	free = 1
+	mu.Unlock()
+	q.notify()
+	assert.NoError(t, <-done)
+	assert.Equal(t, []int{0, 1}, order)
+	assert.Equal(t, int64(0), q.Stats().Timeouts)
+}
@@ -0,0 +1,88 @@
+package balancer
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// StatusRecorder records the status code written to the response
+type StatusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	// hijackedAt is when the connection was upgraded, zero if it wasn't
+	hijackedAt time.Time
+	// discarded is set when the balancer responded itself for reasons not related to the instance
+	discarded bool
+}
+
+// NewStatusRecorder wraps w, the status defaults to 200 as net/http does when the handler doesn't write a header
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// WriteHeader implements http.ResponseWriter
+func (s *StatusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader && status >= http.StatusOK {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Status returns the status code written to the response
+func (s *StatusRecorder) Status() int {
+	return s.status
+}
+
+// Hijack implements http.Hijacker, a hijacked connection switched protocols
+func (s *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil && !s.wroteHeader {
+		s.status = http.StatusSwitchingProtocols
+		s.wroteHeader = true
+		s.hijackedAt = time.Now()
+	}
+	return conn, brw, err
+}
+
+// Elapsed returns the time since start, or until the connection switched protocols for upgrade requests,
+// so long-lived connections aren't taken for slow responses
+func (s *StatusRecorder) Elapsed(start time.Time) time.Duration {
+	if !s.hijackedAt.IsZero() {
+		return s.hijackedAt.Sub(start)
+	}
+	return time.Since(start)
+}
+
+// Unwrap lets http.ResponseController reach the Flusher and Hijacker of the underlying writer
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Succeeded reports whether the response counts as a success, i.e., it is not a 5xx
+func (s *StatusRecorder) Succeeded() bool {
+	return s.status < http.StatusInternalServerError
+}
+
+// Counted reports whether the response reflects the instance, false if the balancer responded itself
+// because the client went away or the client's own deadline passed
+func (s *StatusRecorder) Counted() bool {
+	return !s.discarded
+}
+
+// discardResult marks the StatusRecorders wrapped in w as not reflecting the instance
+func discardResult(w http.ResponseWriter) {
+	for {
+		if rec, ok := w.(*StatusRecorder); ok {
+			rec.discarded = true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
@@ -1,15 +1,38 @@
 package balancer
 
 import (
+	"app/loadbalancer/headers"
+	"app/loadbalancer/rewrite"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	// errInstancesBusy is returned by next when an alive instance is at its max connections and none is available,
+	// the request may wait in the queue for it
+	errInstancesBusy = errors.New("all alive instances are busy")
+	// errInstancesOverLimit is returned by next when an alive instance is over its adaptive concurrency limit and none is available,
+	// the request is shed right away
+	errInstancesOverLimit = errors.New("all alive instances are over their concurrency limit")
+
+	// errors returned by RRInstance.Acquire
+	errMaxConnections   = errors.New("the instance is at its max connections")
+	errConcurrencyLimit = errors.New("the instance is over its concurrency limit")
+	errCircuitOpen      = errors.New("the circuit of the instance is open")
 )
 
 // RoundRobin implements balancer interface
@@ -17,67 +40,192 @@ type RoundRobin struct {
 	instances                    []RRInstance
 	current                      uint32
 	healthCheckIntervalInSeconds int
+	transport                    *statsTransport
+	// queue is nil if the wait queue is disabled
+	queue *waitQueue
+	// failover is nil if the pool has no backup instances
+	failover *failover
+	// locality is nil if the zone aware routing is disabled
+	locality *locality
+	// upgradeGracePeriod is how long Shutdown waits for the upgraded connections to end
+	upgradeGracePeriod time.Duration
 }
 
 // NewRoundRobin new a RoundRobin balancer
-func NewRoundRobin(urls []string, healthCheckIntervalInSeconds int) (*RoundRobin, error) {
+func NewRoundRobin(urls []string, healthCheckIntervalInSeconds int, opts ...Option) (*RoundRobin, error) {
 	if len(urls) == 0 {
 		return nil, errors.New("the input url list is empty")
 	}
+	o := newOptions(opts)
+	transport := o.newTransport()
 	instances := []RRInstance{}
+	hasBackups := false
 	for _, u := range urls {
-		instanceURL, err := url.Parse(u)
-		if err != nil {
-			log.Printf("failed to parse url:%s with error: %s\n", u, err.Error())
+		instance := &RRInstanceImpl{}
+		if err := instance.init(u, transport, o); err != nil {
 			return nil, err
 		}
-		proxy := httputil.NewSingleHostReverseProxy(instanceURL)
-		instances = append(instances, &RRInstanceImpl{
-			URL:          instanceURL,
-			ReverseProxy: proxy,
-			alive:        true,
-		})
-	}
-	return &RoundRobin{
+		instances = append(instances, instance)
+		hasBackups = hasBackups || instance.IsBackup()
+	}
+	rr := &RoundRobin{
 		instances:                    instances,
 		current:                      0,
 		healthCheckIntervalInSeconds: healthCheckIntervalInSeconds,
-	}, nil
+		transport:                    transport,
+		failover:                     newFailover(o, hasBackups),
+		locality:                     newLocality(o),
+		upgradeGracePeriod:           o.upgradeGracePeriod,
+	}
+	if o.queue != nil {
+		rr.queue = newWaitQueue(*o.queue)
+	}
+	publishStats(o.name, rr.Stats)
+	return rr, nil
 }
 
 // ServeHTTP implements http.Handler
 func (rr *RoundRobin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	next, err := rr.next()
+	next, generation, err := rr.acquire(r.Context())
 	if err != nil {
-		log.Printf("failed to find any alive instance")
-		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Printf("failed to acquire an instance with error: %s\n", err.Error())
+		w.WriteHeader(acquireErrorStatus(err))
 		return
 	}
-	rr.instances[next].ServeHTTP(w, r)
+	rec := NewStatusRecorder(w)
+	startTime := time.Now()
+	defer func() {
+		if !rec.Counted() {
+			rr.instances[next].Discard(generation)
+		} else {
+			rr.instances[next].Release(generation, rec.Succeeded(), rec.Elapsed(startTime))
+		}
+		rr.queue.notify()
+	}()
+	rr.instances[next].ServeHTTP(rec, r)
 
 	// log instance index for demo
 	log.Printf("===========New Request===========\n")
 	log.Printf("instance: %d\n", next)
 }
 
-// next decides which instanceIndex the balancer should send the next request to
-func (rr *RoundRobin) next() (uint32, error) {
+// Pick picks and acquires an instance for a request or a connection not served by ServeHTTP, e.g., in TCP mode.
+// The returned release must be called with the result and the latency once it's done.
+func (rr *RoundRobin) Pick(ctx context.Context) (RRInstance, func(success bool, latency time.Duration), error) {
+	next, generation, err := rr.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	instance := rr.instances[next]
+	return instance, func(success bool, latency time.Duration) {
+		instance.Release(generation, success, latency)
+		rr.queue.notify()
+	}, nil
+}
+
+// acquire picks and acquires an instance, waiting in the queue until ctx is done if all alive instances are busy
+// or other requests are already waiting. The circuit generation of the instance is passed on to Release.
+func (rr *RoundRobin) acquire(ctx context.Context) (uint32, uint64, error) {
+	if rr.queue == nil {
+		return rr.next()
+	}
+	var next uint32
+	var generation uint64
+	err := rr.queue.acquire(ctx, func() error {
+		var err error
+		next, generation, err = rr.next()
+		return err
+	})
+	return next, generation, err
+}
+
+// next decides which instanceIndex the balancer should send the next request to.
+// The picked instance is acquired and must be released with the returned circuit generation once the request is done.
+func (rr *RoundRobin) next() (uint32, uint64, error) {
+	s := newSelection(len(rr.instances), func(i int) RRInstance { return rr.instances[i] }, rr.failover, rr.locality)
+	instanceIdx, generation, err := rr.pick(false, s)
+	if errors.Is(err, errSlowStartSkipped) {
+		// the available instances were all skipped by chance while slow starting, pick one of them anyway
+		return rr.pick(true, s)
+	}
+	return instanceIdx, generation, err
+}
+
+// pick loops the instances once from the current position, instances in slow start are skipped
+// with the probability of their missing weight unless ignoreSlowStart, instances out of the selection s are skipped
+func (rr *RoundRobin) pick(ignoreSlowStart bool, s selection) (uint32, uint64, error) {
 	length := uint32(len(rr.instances))
 	if length == 0 {
-		return 0, errors.New("instance list is empty")
+		return 0, 0, errors.New("instance list is empty")
 	}
 	// loop to find an alive instance and retry no more than `length` times
+	unavailable := unavailableInstances{}
 	for i := uint32(0); i < length; i++ {
 		next := atomic.AddUint32(&rr.current, 1)
 		instanceIdx := next % length
 
-		if rr.instances[instanceIdx].IsAlive() {
-			return instanceIdx, nil
+		if !isAvailable(rr.instances[instanceIdx]) {
+			// continue until finding an alive instance not draining
+			continue
 		}
-		// continue until finding an alive instance
+		if !s.allows(rr.instances[instanceIdx]) {
+			continue
+		}
+		if !ignoreSlowStart && rand.Float64() >= rr.instances[instanceIdx].SlowStartFactor() {
+			unavailable.slowStartSkipped = true
+			continue
+		}
+		generation, err := rr.instances[instanceIdx].Acquire()
+		if err == nil {
+			return instanceIdx, generation, nil
+		}
+		unavailable.add(err)
+	}
+	return 0, 0, unavailable.err()
+}
+
+// acquireErrorStatus returns the status of a request no instance was acquired for,
+// 504 if its deadline passed while it waited in the queue, otherwise 503
+func acquireErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusServiceUnavailable
+}
+
+// errSlowStartSkipped is returned by pick when no instance is picked and some were skipped for being in slow start
+var errSlowStartSkipped = errors.New("all available instances are skipped in slow start")
+
+// unavailableInstances collects why the alive instances couldn't be acquired
+type unavailableInstances struct {
+	busy             bool
+	overLimit        bool
+	slowStartSkipped bool
+}
+
+func (u *unavailableInstances) add(err error) {
+	switch err {
+	case errMaxConnections:
+		u.busy = true
+	case errConcurrencyLimit:
+		u.overLimit = true
+	}
+	// instances with open circuits are treated as dead ones
+}
+
+// err returns the error of next, waiting in the queue is preferred to shedding
+func (u *unavailableInstances) err() error {
+	if u.slowStartSkipped {
+		return errSlowStartSkipped
+	}
+	if u.busy {
+		return errInstancesBusy
+	}
+	if u.overLimit {
+		return errInstancesOverLimit
 	}
 	// all registered instances are not alive
-	return 0, errors.New("failed to find any alive instance")
+	return errors.New("failed to find any alive instance")
 }
 
 // HealthCheck run a round of health check on its instances
@@ -99,31 +247,224 @@ func (rr *RoundRobin) GetHealthCheckInterval() int {
 	return rr.healthCheckIntervalInSeconds
 }
 
+// SetDraining drains the instance with the url or puts it back in rotation
+func (rr *RoundRobin) SetDraining(url string, draining bool) error {
+	return setDraining(rr.instances, url, draining)
+}
+
+// Shutdown waits up to the upgrade grace period for the upgraded connections to end,
+// then closes the remaining ones, sending a close frame to the WebSockets
+func (rr *RoundRobin) Shutdown() {
+	shutdownUpgraded(rr.instances, rr.upgradeGracePeriod)
+}
+
+// QueueWait returns how long the oldest request in the wait queue has waited, 0 if none is waiting
+func (rr *RoundRobin) QueueWait() time.Duration {
+	return rr.queue.oldestWait()
+}
+
+// Stats returns a snapshot of the pool state
+func (rr *RoundRobin) Stats() PoolStats {
+	stats := PoolStats{}
+	if rr.transport != nil {
+		stats.Transport = rr.transport.Stats()
+	}
+	for _, instance := range rr.instances {
+		stats.Instances = append(stats.Instances, instance.Stats())
+	}
+	if rr.queue != nil {
+		queue := rr.queue.Stats()
+		stats.Queue = &queue
+	}
+	stats.Failover = rr.failover.isActive()
+	stats.ZoneSpillover = rr.locality.isSpillover()
+	return stats
+}
+
 // RRInstance defines the instance interface
 type RRInstance interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 	CheckAliveness() bool
 	IsAlive() bool
 	SetAlive(alive bool)
+	// IsDraining returns whether the instance takes no new requests while finishing the ones in flight
+	IsDraining() bool
+	SetDraining(draining bool)
+	// IsBackup returns whether the instance only takes traffic when the pool failed over, see WithFailoverThreshold
+	IsBackup() bool
+	// Zone returns the zone of the instance, see WithLocality
+	Zone() string
+	// IsCircuitOpen returns whether the circuit of the instance rejects all requests, see WithCircuitBreaker
+	IsCircuitOpen() bool
+	// Addr returns the host:port of the instance, filling in the default port of the scheme
+	Addr() string
+	// CloseUpgraded closes the upgraded connections of the instance, sending a close frame to the WebSockets
+	CloseUpgraded()
+	// Acquire reserves the instance for a request, it fails if the instance is at its max connections,
+	// over its adaptive concurrency limit or its circuit is open. It returns the circuit generation to release the request with.
+	Acquire() (uint64, error)
+	// Release ends a request reserved by Acquire in the circuit generation with its result and latency
+	Release(generation uint64, success bool, latency time.Duration)
+	// Discard ends a request reserved by Acquire whose result doesn't reflect the instance, e.g., the client went away
+	Discard(generation uint64)
+	// SlowStartFactor returns the effective weight in (0, 1] of the instance, less than 1 while it's slow starting
+	SlowStartFactor() float64
+	Stats() InstanceStats
 }
 
 // RRInstanceImpl implements the RRInstance interface
 type RRInstanceImpl struct {
 	URL          *url.URL
 	ReverseProxy *httputil.ReverseProxy
+	// TLSConfig is used by the health check probe of https instances, nil means the default config
+	TLSConfig *tls.Config
 
-	mu    sync.RWMutex
-	alive bool
+	mu       sync.RWMutex
+	alive    bool
+	inFlight int64
+	// maxConnections is the in-flight limit, 0 means unlimited
+	maxConnections int64
+	// breaker is nil if the circuit breaker is disabled
+	breaker *CircuitBreaker
+	// limiter is nil if the adaptive concurrency limit is disabled
+	limiter *AdaptiveLimiter
+	// slowStart is nil if the slow start is disabled, recoveredAt is when the instance was added or last became alive
+	slowStart   *SlowStartOptions
+	recoveredAt time.Time
+	// backup instances only take traffic when the pool failed over
+	backup bool
+	zone   string
+	// adminDraining is set by the admin API, healthDraining by the HTTP health check
+	adminDraining  bool
+	healthDraining bool
+	// healthCheck is nil if the HTTP and gRPC health checks are disabled,
+	// healthClient is nil unless the HTTP one is enabled and grpcHealth unless the gRPC one is
+	healthCheck  *HealthCheckOptions
+	healthClient *http.Client
+	grpcHealth   healthpb.HealthClient
+	// upgrades tracks the connections switched to another protocol, e.g., WebSockets
+	upgrades *upgrades
 }
 
-// ServeHTTP implements http.Handler
+// init parses the url and sets up an alive instance proxying through the given transport
+func (i *RRInstanceImpl) init(u string, transport *statsTransport, o *options) error {
+	instanceURL, err := url.Parse(u)
+	if err != nil {
+		log.Printf("failed to parse url:%s with error: %s\n", u, err.Error())
+		return err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(instanceURL)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		rewrite.Apply(r)
+		director(r)
+		propagateDeadline(r)
+		headers.ApplyRequest(r, instanceURL.Host)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		headers.ApplyResponse(resp, instanceURL.Host)
+		return nil
+	}
+	if proxy.Transport, err = transport.forProtocol(o.instances[u].Protocol, instanceURL.Scheme); err != nil {
+		return fmt.Errorf("instance %s: %w", u, err)
+	}
+	proxy.ErrorHandler = proxyErrorHandler
+	i.URL = instanceURL
+	i.ReverseProxy = proxy
+	i.TLSConfig = o.tlsConfig
+	i.alive = true
+	i.maxConnections = int64(o.instances[u].MaxConnections)
+	i.backup = o.instances[u].Backup
+	i.zone = o.instances[u].Zone
+	i.slowStart = o.slowStart
+	if i.slowStart != nil {
+		// a newly added instance slow starts like a recovered one
+		i.recoveredAt = time.Now()
+	}
+	i.healthCheck = o.healthCheck
+	i.healthClient = o.healthClient
+	if o.healthCheck != nil {
+		switch o.healthCheck.Type {
+		case "", HealthCheckHTTP:
+		case HealthCheckGRPC:
+			if i.grpcHealth, err = i.newGRPCHealthClient(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown health check type %q, should be http or grpc", o.healthCheck.Type)
+		}
+	}
+	i.upgrades = newUpgrades(o.upgradeGracePeriod)
+	if o.circuitBreaker != nil {
+		i.breaker = NewCircuitBreaker(u, *o.circuitBreaker)
+	}
+	if o.adaptiveLimit != nil {
+		if i.limiter, err = NewAdaptiveLimiter(*o.adaptiveLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler. An upgraded connection is served until it's closed,
+// so it counts toward the in-flight requests of the instance for its whole life.
 func (i *RRInstanceImpl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if IsUpgrade(r) && i.upgrades != nil {
+		w = &upgradeWriter{
+			ResponseWriter: w,
+			upgrades:       i.upgrades,
+			websocket:      strings.EqualFold(r.Header.Get("Upgrade"), "websocket"),
+		}
+	}
 	i.ReverseProxy.ServeHTTP(w, r)
 }
 
-// CheckAliveness dials a TCP connection to instance to check its aliveness
+// proxyErrorHandler responds the proxy errors, 413 if the body exceeded the limit of the BodyLimit middleware,
+// 504 if the deadline of the Deadline middleware passed, otherwise 502.
+// The responses to a client gone away or whose own deadline passed are not counted against the instance.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		log.Printf("request body exceeded %d bytes: %s\n", maxBytesErr.Limit, r.URL.Path)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		log.Printf("upstream request to %s timed out: %s\n", r.URL.Host, r.URL.Path)
+		if isClientDeadline(r.Context()) {
+			discardResult(w)
+		}
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled) {
+		log.Printf("client canceled the request to %s: %s\n", r.URL.Host, r.URL.Path)
+		discardResult(w)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	log.Printf("failed to proxy request to %s with error: %s\n", r.URL.Host, err.Error())
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// CheckAliveness dials a TCP connection to instance to check its aliveness.
+// For https instances the TLS handshake is also done, so certificates are validated the same way as the proxied traffic.
+// If the HTTP or gRPC health check is enabled, it's run instead, see HealthCheckOptions.
 func (i *RRInstanceImpl) CheckAliveness() bool {
-	conn, err := net.DialTimeout("tcp", i.URL.Host, 1*time.Second)
+	if i.grpcHealth != nil {
+		return i.checkGRPC()
+	}
+	if i.healthClient != nil {
+		return i.checkHTTP()
+	}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 1 * time.Second}
+	if i.URL.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", i.Addr(), i.probeTLSConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", i.Addr())
+	}
 	if err != nil {
 		log.Printf("failed to connect to url:%s with error:%s", i.URL.Host, err.Error())
 		return false
@@ -132,6 +473,31 @@ func (i *RRInstanceImpl) CheckAliveness() bool {
 	return true
 }
 
+// Addr implements RRInstance
+func (i *RRInstanceImpl) Addr() string {
+	if i.URL.Port() != "" {
+		return i.URL.Host
+	}
+	if i.URL.Scheme == "https" {
+		return net.JoinHostPort(i.URL.Hostname(), "443")
+	}
+	return net.JoinHostPort(i.URL.Hostname(), "80")
+}
+
+// probeTLSConfig returns the TLS config for the health check probe with the server name set the way http.Transport does
+func (i *RRInstanceImpl) probeTLSConfig() *tls.Config {
+	var cfg *tls.Config
+	if i.TLSConfig != nil {
+		cfg = i.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = i.URL.Hostname()
+	}
+	return cfg
+}
+
 // IsAlive returns the alive field
 func (i *RRInstanceImpl) IsAlive() bool {
 	var alive bool
@@ -141,9 +507,130 @@ func (i *RRInstanceImpl) IsAlive() bool {
 	return alive
 }
 
-// SetAlive sets the alive field
+// SetAlive sets the alive field, an instance becoming alive starts its slow start
 func (i *RRInstanceImpl) SetAlive(alive bool) {
 	i.mu.Lock()
+	if alive && !i.alive {
+		i.recoveredAt = time.Now()
+	}
 	i.alive = alive
 	i.mu.Unlock()
 }
+
+// IsBackup returns the backup field
+func (i *RRInstanceImpl) IsBackup() bool {
+	return i.backup
+}
+
+// Zone returns the zone field
+func (i *RRInstanceImpl) Zone() string {
+	return i.zone
+}
+
+// CloseUpgraded closes the upgraded connections of the instance, sending a close frame to the WebSockets
+func (i *RRInstanceImpl) CloseUpgraded() {
+	i.upgrades.goAway()
+}
+
+// SlowStartFactor returns the effective weight in (0, 1] of the instance, ramping up after it became alive
+func (i *RRInstanceImpl) SlowStartFactor() float64 {
+	if i.slowStart == nil {
+		return 1
+	}
+	i.mu.RLock()
+	recoveredAt := i.recoveredAt
+	i.mu.RUnlock()
+	if recoveredAt.IsZero() {
+		return 1
+	}
+	return i.slowStart.factor(time.Since(recoveredAt))
+}
+
+// IsCircuitOpen implements RRInstance
+func (i *RRInstanceImpl) IsCircuitOpen() bool {
+	return i.breaker != nil && i.breaker.IsOpen()
+}
+
+// Acquire reserves the instance for a request, it fails if the instance is at its max connections,
+// over its adaptive concurrency limit or its circuit is open. Every acquired request must be released.
+func (i *RRInstanceImpl) Acquire() (uint64, error) {
+	if !i.reserveConnection() {
+		return 0, errMaxConnections
+	}
+	if i.limiter != nil && atomic.LoadInt64(&i.inFlight) > i.limiter.Limit() {
+		atomic.AddInt64(&i.inFlight, -1)
+		i.limiter.Shed()
+		return 0, errConcurrencyLimit
+	}
+	if i.breaker == nil {
+		return 0, nil
+	}
+	generation, ok := i.breaker.Allow()
+	if !ok {
+		atomic.AddInt64(&i.inFlight, -1)
+		return 0, errCircuitOpen
+	}
+	return generation, nil
+}
+
+// reserveConnection increments the in-flight count unless the instance is at its max connections
+func (i *RRInstanceImpl) reserveConnection() bool {
+	if i.maxConnections <= 0 {
+		atomic.AddInt64(&i.inFlight, 1)
+		return true
+	}
+	for {
+		inFlight := atomic.LoadInt64(&i.inFlight)
+		if inFlight >= i.maxConnections {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&i.inFlight, inFlight, inFlight+1) {
+			return true
+		}
+	}
+}
+
+// Release ends a request reserved by Acquire and records its result to the circuit breaker and the adaptive limiter
+func (i *RRInstanceImpl) Release(generation uint64, success bool, latency time.Duration) {
+	inFlight := atomic.AddInt64(&i.inFlight, -1) + 1
+	if i.breaker != nil {
+		i.breaker.Record(generation, success)
+	}
+	if i.limiter != nil {
+		i.limiter.OnSample(latency, inFlight, !success)
+	}
+}
+
+// Discard ends a request reserved by Acquire without recording a result to the circuit breaker,
+// a trial request of the half-open state is given back. The adaptive limiter takes no sample either,
+// since the latency cut short by the client is neither a drop nor the latency of the instance.
+func (i *RRInstanceImpl) Discard(generation uint64) {
+	atomic.AddInt64(&i.inFlight, -1)
+	if i.breaker != nil {
+		i.breaker.Cancel(generation)
+	}
+}
+
+// Stats returns a snapshot of the instance state
+func (i *RRInstanceImpl) Stats() InstanceStats {
+	stats := InstanceStats{
+		URL:             i.URL.String(),
+		Alive:           i.IsAlive(),
+		Draining:        i.IsDraining(),
+		Backup:          i.backup,
+		Zone:            i.zone,
+		InFlight:        atomic.LoadInt64(&i.inFlight),
+		Upgraded:        i.upgrades.count(),
+		MaxConnections:  int(i.maxConnections),
+		SlowStartFactor: i.SlowStartFactor(),
+	}
+	if i.breaker != nil {
+		circuit := i.breaker.Stats()
+		stats.Circuit = &circuit
+	}
+	if i.limiter != nil {
+		limit := i.limiter.Stats()
+		stats.AdaptiveLimit = &limit
+	}
+	return stats
+}
@@ -1,9 +1,15 @@
 package balancer
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -73,6 +79,101 @@ func TestRoundRobinNext(t *testing.T) {
 			exp:    2,
 			expErr: nil,
 		},
+		{
+			name: "skip open circuit instance",
+			roundRobin: &RoundRobin{
+				instances: []RRInstance{
+					&RRInstanceImpl{
+						URL:   url8081,
+						alive: true,
+					},
+					&RRInstanceImpl{
+						URL:     url8082,
+						alive:   true,
+						breaker: openCircuitBreaker(),
+					},
+					&RRInstanceImpl{
+						URL:   url8083,
+						alive: true,
+					},
+				},
+				current:                      30, // next = 31 % 3 = 1
+				healthCheckIntervalInSeconds: 5,
+			},
+			exp:    2,
+			expErr: nil,
+		},
+		{
+			name: "skip instance at max connections",
+			roundRobin: &RoundRobin{
+				instances: []RRInstance{
+					&RRInstanceImpl{
+						URL:   url8081,
+						alive: true,
+					},
+					&RRInstanceImpl{
+						URL:            url8082,
+						alive:          true,
+						inFlight:       100,
+						maxConnections: 100,
+					},
+					&RRInstanceImpl{
+						URL:   url8083,
+						alive: true,
+					},
+				},
+				current:                      30, // next = 31 % 3 = 1
+				healthCheckIntervalInSeconds: 5,
+			},
+			exp:    2,
+			expErr: nil,
+		},
+		{
+			name: "all alive instances are busy",
+			roundRobin: &RoundRobin{
+				instances: []RRInstance{
+					&RRInstanceImpl{
+						URL:   url8081,
+						alive: false,
+					},
+					&RRInstanceImpl{
+						URL:            url8082,
+						alive:          true,
+						inFlight:       100,
+						maxConnections: 100,
+					},
+				},
+				current:                      30,
+				healthCheckIntervalInSeconds: 5,
+			},
+			exp:    0,
+			expErr: errInstancesBusy,
+		},
+		{
+			name: "skip draining instance",
+			roundRobin: &RoundRobin{
+				instances: []RRInstance{
+					&RRInstanceImpl{
+						URL:   url8081,
+						alive: true,
+					},
+					&RRInstanceImpl{
+						URL:           url8082,
+						alive:         true,
+						adminDraining: true,
+					},
+					&RRInstanceImpl{
+						URL:            url8083,
+						alive:          true,
+						healthDraining: true,
+					},
+				},
+				current:                      30, // next = 31 % 3 = 1
+				healthCheckIntervalInSeconds: 5,
+			},
+			exp:    0,
+			expErr: nil,
+		},
 		{
 			name: "no alive instance",
 			roundRobin: &RoundRobin{
@@ -100,7 +201,7 @@ func TestRoundRobinNext(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			next, err := tt.roundRobin.next()
+			next, _, err := tt.roundRobin.next()
 			if tt.expErr != nil {
 				assert.EqualError(t, err, tt.expErr.Error())
 			} else {
@@ -110,3 +211,206 @@ func TestRoundRobinNext(t *testing.T) {
 		})
 	}
 }
+
+func TestRRInstanceCheckAliveness(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	closedServer := httptest.NewServer(handler)
+	closedServer.Close()
+
+	parse := func(u string) *url.URL { parsed, _ := url.Parse(u); return parsed }
+	trustedConfig := tlsServer.Client().Transport.(*http.Transport).TLSClientConfig
+
+	tests := []struct {
+		name     string
+		instance *RRInstanceImpl
+		exp      bool
+	}{
+		{
+			name:     "http instance accepting connections",
+			instance: &RRInstanceImpl{URL: parse(httpServer.URL)},
+			exp:      true,
+		},
+		{
+			name:     "http instance refusing connections",
+			instance: &RRInstanceImpl{URL: parse(closedServer.URL)},
+			exp:      false,
+		},
+		{
+			name:     "https instance with trusted CA",
+			instance: &RRInstanceImpl{URL: parse(tlsServer.URL), TLSConfig: trustedConfig},
+			exp:      true,
+		},
+		{
+			name:     "https instance with unknown CA",
+			instance: &RRInstanceImpl{URL: parse(tlsServer.URL)},
+			exp:      false,
+		},
+		{
+			name:     "https instance with unknown CA and InsecureSkipVerify",
+			instance: &RRInstanceImpl{URL: parse(tlsServer.URL), TLSConfig: &tls.Config{InsecureSkipVerify: true}},
+			exp:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.exp, tt.instance.CheckAliveness())
+		})
+	}
+}
+
+func TestRoundRobinServeHTTPWithTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer tlsServer.Close()
+	trustedConfig := tlsServer.Client().Transport.(*http.Transport).TLSClientConfig
+
+	rr, err := NewRoundRobin([]string{tlsServer.URL}, 5, WithTLSConfig(trustedConfig))
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	rr.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestRoundRobinCircuitIgnoresClientErrors(t *testing.T) {
+	t.Parallel()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	tests := []struct {
+		name     string
+		ctx      func(ctx context.Context) (context.Context, context.CancelFunc)
+		expCode  int
+		expState CircuitState
+	}{
+		{
+			name: "client deadline",
+			ctx: func(ctx context.Context) (context.Context, context.CancelFunc) {
+				return context.WithTimeout(WithClientDeadline(ctx), 10*time.Millisecond)
+			},
+			expCode:  http.StatusGatewayTimeout,
+			expState: CircuitClosed,
+		},
+		{
+			name: "client gone away",
+			ctx: func(ctx context.Context) (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(ctx)
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			expCode:  http.StatusBadGateway,
+			expState: CircuitClosed,
+		},
+		{
+			name: "route deadline",
+			ctx: func(ctx context.Context) (context.Context, context.CancelFunc) {
+				return context.WithTimeout(ctx, 10*time.Millisecond)
+			},
+			expCode:  http.StatusGatewayTimeout,
+			expState: CircuitOpen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := NewRoundRobin([]string{slow.URL}, 5,
+				WithCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 3, OpenDuration: time.Hour}))
+			assert.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+				ctx, cancel := tt.ctx(r.Context())
+				w := httptest.NewRecorder()
+				rr.ServeHTTP(w, r.WithContext(ctx))
+				cancel()
+				assert.Equal(t, tt.expCode, w.Code)
+			}
+			instance := rr.Stats().Instances[0]
+			assert.Equal(t, tt.expState, instance.Circuit.State)
+			assert.Equal(t, int64(0), instance.InFlight)
+		})
+	}
+}
+
+// openCircuitBreaker returns a circuit breaker tripped by one failure
+func openCircuitBreaker() *CircuitBreaker {
+	cb := NewCircuitBreaker("test", CircuitBreakerOptions{ConsecutiveFailures: 1, OpenDuration: time.Hour})
+	record(cb, false)
+	return cb
+}
+
+func TestPick(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	u := "tcp://" + l.Addr().String()
+	opts := []Option{
+		WithInstanceOptions(u, InstanceOptions{MaxConnections: 1}),
+		WithQueue(QueueOptions{MaxDepth: 1, Timeout: time.Second}),
+	}
+	rr, err := NewRoundRobin([]string{u}, 5, append(opts, WithName("pick-rr"))...)
+	assert.NoError(t, err)
+	wrr, err := NewWeightedRoundRobin([]string{u}, 5, append(opts, WithName("pick-wrr"))...)
+	assert.NoError(t, err)
+	// the weights are computed from the EWMA latency by the health check, the TCP probe dials the listener
+	wrr.instances[0].SetEWMALatency(int64(time.Millisecond))
+	wrr.HealthCheck()
+
+	tests := []struct {
+		name string
+		pick func(ctx context.Context) (RRInstance, func(success bool, latency time.Duration), error)
+	}{
+		{
+			name: "round robin",
+			pick: rr.Pick,
+		},
+		{
+			name: "weighted round robin",
+			pick: wrr.Pick,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance, release, err := tt.pick(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, l.Addr().String(), instance.Addr())
+			assert.Equal(t, int64(1), instance.Stats().InFlight)
+
+			// the instance is at its max connections, the next pick waits in the queue until ctx is done
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, _, err = tt.pick(ctx)
+			assert.Error(t, err)
+
+			picked := make(chan error)
+			go func() {
+				_, release, err := tt.pick(context.Background())
+				if err == nil {
+					release(true, time.Millisecond)
+				}
+				picked <- err
+			}()
+			release(true, time.Millisecond)
+			assert.NoError(t, <-picked)
+			assert.Equal(t, int64(0), instance.Stats().InFlight)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package balancer
+
+// selection is the set of instances a request may be sent to, decided once per request before picking
+type selection struct {
+	// useBackups is true while the pool failed over to its backup instances
+	useBackups bool
+	// zone is the zone the instances are picked from, empty means all zones
+	zone string
+}
+
+// newSelection decides the selection of a request from the instances of a pool.
+// It's the full set, skipping nothing but backups, unless the pool has backups or zone aware routing.
+func newSelection(length int, instance func(i int) RRInstance, f *failover, l *locality) selection {
+	s := selection{}
+	if f != nil {
+		availablePrimaries := 0
+		for i := 0; i < length; i++ {
+			if !instance(i).IsBackup() && isAvailable(instance(i)) {
+				availablePrimaries++
+			}
+		}
+		s.useBackups = f.update(availablePrimaries)
+	}
+	if l != nil {
+		available, total := 0, 0
+		for i := 0; i < length; i++ {
+			if instance(i).Zone() != l.zone || (!s.useBackups && instance(i).IsBackup()) {
+				continue
+			}
+			total++
+			if isAvailable(instance(i)) {
+				available++
+			}
+		}
+		if l.update(available, total) {
+			s.zone = l.zone
+		}
+	}
+	return s
+}
+
+// allows returns whether the instance is in the selection
+func (s selection) allows(instance RRInstance) bool {
+	if !s.useBackups && instance.IsBackup() {
+		return false
+	}
+	return s.zone == "" || instance.Zone() == s.zone
+}
+
+// isAvailable returns whether an instance can take new requests, i.e., it's alive, not draining and its circuit isn't open.
+// Instances with open circuits are treated like dead ones, so the pool fails over to its backups or other zones.
+func isAvailable(instance RRInstance) bool {
+	return instance.IsAlive() && !instance.IsDraining() && !instance.IsCircuitOpen()
+}
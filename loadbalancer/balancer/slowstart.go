@@ -0,0 +1,34 @@
+package balancer
+
+import (
+	"math"
+	"time"
+)
+
+// SlowStartOptions holds the settings of the slow start of recovered instances
+type SlowStartOptions struct {
+	// Window is how long the effective weight of a recovered instance takes to ramp up to full
+	Window time.Duration
+	// MinWeightPercent is the effective weight at the start of the window in percent of the full weight, default 10
+	MinWeightPercent float64
+	// Aggression shapes the ramp curve as (elapsed / Window) ^ (1 / Aggression), default 1 for linear.
+	// Greater values ramp up faster at the start of the window, lower values slower.
+	Aggression float64
+}
+
+// factor returns the effective weight in [MinWeightPercent / 100, 1] of an instance recovered `elapsed` ago
+func (o *SlowStartOptions) factor(elapsed time.Duration) float64 {
+	if o.Window <= 0 || elapsed >= o.Window {
+		return 1
+	}
+	minFactor := o.MinWeightPercent / 100
+	if minFactor <= 0 || minFactor > 1 {
+		minFactor = 0.1
+	}
+	aggression := o.Aggression
+	if aggression <= 0 {
+		aggression = 1
+	}
+	ramp := math.Pow(float64(elapsed)/float64(o.Window), 1/aggression)
+	return math.Max(minFactor, ramp)
+}
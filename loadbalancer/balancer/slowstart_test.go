@@ -0,0 +1,101 @@
+package balancer
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowStartFactor(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		opts    SlowStartOptions
+		elapsed time.Duration
+		exp     float64
+	}{
+		{name: "disabled", opts: SlowStartOptions{}, elapsed: 0, exp: 1},
+		{name: "start of the window", opts: SlowStartOptions{Window: 10 * time.Second}, elapsed: 0, exp: 0.1},
+		{name: "linear ramp", opts: SlowStartOptions{Window: 10 * time.Second}, elapsed: 5 * time.Second, exp: 0.5},
+		{name: "min weight", opts: SlowStartOptions{Window: 10 * time.Second, MinWeightPercent: 30}, elapsed: 2 * time.Second, exp: 0.3},
+		{name: "aggressive ramp", opts: SlowStartOptions{Window: 10 * time.Second, Aggression: 2}, elapsed: 2500 * time.Millisecond, exp: 0.5},
+		{name: "end of the window", opts: SlowStartOptions{Window: 10 * time.Second}, elapsed: 10 * time.Second, exp: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.exp, tt.opts.factor(tt.elapsed), 1e-9)
+		})
+	}
+}
+
+func TestRRInstanceSlowStart(t *testing.T) {
+	t.Parallel()
+
+	instance := &RRInstanceImpl{
+		alive:     true,
+		slowStart: &SlowStartOptions{Window: time.Hour},
+	}
+	// instances which never recovered take their full share
+	assert.Equal(t, float64(1), instance.SlowStartFactor())
+
+	instance.SetAlive(false)
+	instance.SetAlive(true)
+	assert.InDelta(t, 0.1, instance.SlowStartFactor(), 0.01)
+
+	// newly added instances slow start too
+	rr, err := NewRoundRobin([]string{"http://localhost:8081"}, 5,
+		WithName("slow-start-added"),
+		WithSlowStart(SlowStartOptions{Window: time.Hour}))
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.1, rr.Stats().Instances[0].SlowStartFactor, 0.01)
+}
+
+func TestRoundRobinNextSlowStart(t *testing.T) {
+	t.Parallel()
+
+	url8081 := func() *url.URL { u, _ := url.Parse("http://localhost:8081"); return u }()
+	url8082 := func() *url.URL { u, _ := url.Parse("http://localhost:8082"); return u }()
+	recovering := &RRInstanceImpl{
+		URL:         url8082,
+		alive:       true,
+		slowStart:   &SlowStartOptions{Window: time.Hour},
+		recoveredAt: time.Now(),
+	}
+
+	t.Run("recovering instance gets a small share", func(t *testing.T) {
+		rr := &RoundRobin{
+			instances: []RRInstance{
+				&RRInstanceImpl{URL: url8081, alive: true},
+				recovering,
+			},
+		}
+		picks := make([]int, 2)
+		for i := 0; i < 10000; i++ {
+			next, generation, err := rr.next()
+			assert.NoError(t, err)
+			rr.instances[next].Release(generation, true, 0)
+			picks[next]++
+		}
+		assert.Greater(t, picks[1], 500)
+		assert.Less(t, picks[1], 1500)
+	})
+
+	t.Run("recovering instance is picked when it's the only one", func(t *testing.T) {
+		rr := &RoundRobin{
+			instances: []RRInstance{
+				&RRInstanceImpl{URL: url8081, alive: false},
+				recovering,
+			},
+		}
+		for i := 0; i < 100; i++ {
+			next, generation, err := rr.next()
+			assert.NoError(t, err)
+			assert.Equal(t, uint32(1), next)
+			rr.instances[next].Release(generation, true, 0)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// TransportOptions holds the settings of the upstream transport, zero values keep the http.DefaultTransport settings
+type TransportOptions struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLSHandshakeTimeout   time.Duration
+	DialTimeout           time.Duration
+	// KeepAlive is the TCP keep-alive period, negative disables TCP keep-alive probes
+	KeepAlive time.Duration
+	// DisableKeepAlives disables HTTP keep-alive so every request uses a new connection
+	DisableKeepAlives bool
+}
+
+// TransportStats is a snapshot of the connection pool usage of a transport
+type TransportStats struct {
+	// OpenConns is the number of connections currently open, both in use and idle
+	OpenConns int64 `json:"openConns"`
+	// Dials and DialErrors count the connection attempts
+	Dials      int64 `json:"dials"`
+	DialErrors int64 `json:"dialErrors"`
+	// InFlight is the number of requests currently waiting for their response headers
+	InFlight int64 `json:"inFlight"`
+	// Requests counts the requests sent, ReusedConns counts the ones sent on an idle pooled connection
+	Requests    int64 `json:"requests"`
+	ReusedConns int64 `json:"reusedConns"`
+}
+
+// statsTransport wraps an http.Transport and records its connection pool usage
+type statsTransport struct {
+	transport *http.Transport
+	// protocols holds the transports of the instances with an upstream protocol, see forProtocol
+	protocols map[string]http.RoundTripper
+	stats     TransportStats
+}
+
+// newTransport builds the dedicated upstream transport shared by all instances of a balancer
+func (o *options) newTransport() *statsTransport {
+	t := &statsTransport{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if o.tlsConfig != nil {
+		transport.TLSClientConfig = o.tlsConfig.Clone()
+	}
+
+	to := o.transportOptions
+	if to.MaxIdleConns != 0 {
+		transport.MaxIdleConns = to.MaxIdleConns
+	}
+	if to.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = to.MaxIdleConnsPerHost
+	}
+	if to.MaxConnsPerHost != 0 {
+		transport.MaxConnsPerHost = to.MaxConnsPerHost
+	}
+	if to.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = to.IdleConnTimeout
+	}
+	if to.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = to.ResponseHeaderTimeout
+	}
+	if to.TLSHandshakeTimeout != 0 {
+		transport.TLSHandshakeTimeout = to.TLSHandshakeTimeout
+	}
+	transport.DisableKeepAlives = to.DisableKeepAlives
+
+	// same defaults as http.DefaultTransport
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if to.DialTimeout != 0 {
+		dialer.Timeout = to.DialTimeout
+	}
+	if to.KeepAlive != 0 {
+		dialer.KeepAlive = to.KeepAlive
+	}
+	dial := t.countingDial(dialer.DialContext)
+	transport.DialContext = dial
+
+	t.transport = transport
+	t.newProtocolTransports(o, dial)
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *statsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.roundTrip(t.transport, r)
+}
+
+// roundTrip sends the request through the transport, recording it in the stats
+func (t *statsTransport) roundTrip(transport http.RoundTripper, r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.stats.Requests, 1)
+	atomic.AddInt64(&t.stats.InFlight, 1)
+	defer atomic.AddInt64(&t.stats.InFlight, -1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&t.stats.ReusedConns, 1)
+			}
+		},
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+	return transport.RoundTrip(r)
+}
+
+// Stats returns a snapshot of the connection pool usage
+func (t *statsTransport) Stats() TransportStats {
+	return TransportStats{
+		OpenConns:   atomic.LoadInt64(&t.stats.OpenConns),
+		Dials:       atomic.LoadInt64(&t.stats.Dials),
+		DialErrors:  atomic.LoadInt64(&t.stats.DialErrors),
+		InFlight:    atomic.LoadInt64(&t.stats.InFlight),
+		Requests:    atomic.LoadInt64(&t.stats.Requests),
+		ReusedConns: atomic.LoadInt64(&t.stats.ReusedConns),
+	}
+}
+
+// countingDial wraps the dial function to keep track of the open connections
+func (t *statsTransport) countingDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt64(&t.stats.Dials, 1)
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			atomic.AddInt64(&t.stats.DialErrors, 1)
+			return nil, err
+		}
+		atomic.AddInt64(&t.stats.OpenConns, 1)
+		return &countedConn{Conn: conn, openConns: &t.stats.OpenConns}, nil
+	}
+}
+
+// countedConn decrements the open connection counter once when closed
+type countedConn struct {
+	net.Conn
+	openConns *int64
+	closed    int32
+}
+
+// Close implements net.Conn
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(c.openConns, -1)
+	}
+	return c.Conn.Close()
+}
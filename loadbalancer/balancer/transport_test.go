@@ -0,0 +1,79 @@
+package balancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	t.Parallel()
+
+	o := newOptions([]Option{WithTransportOptions(TransportOptions{
+		MaxIdleConnsPerHost:   50,
+		MaxConnsPerHost:       100,
+		IdleConnTimeout:       10 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Second,
+	})})
+	transport := o.newTransport().transport
+
+	assert.Equal(t, 50, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 100, transport.MaxConnsPerHost)
+	assert.Equal(t, 10*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 2*time.Second, transport.ResponseHeaderTimeout)
+	// unset fields keep the http.DefaultTransport settings
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).MaxIdleConns, transport.MaxIdleConns)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+}
+
+func TestStatsTransport(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tests := []struct {
+		name             string
+		transportOptions TransportOptions
+		exp              TransportStats
+	}{
+		{
+			name:             "keep-alive reuses the pooled connection",
+			transportOptions: TransportOptions{},
+			exp: TransportStats{
+				OpenConns:   1,
+				Dials:       1,
+				Requests:    3,
+				ReusedConns: 2,
+			},
+		},
+		{
+			name:             "disabled keep-alive dials every request",
+			transportOptions: TransportOptions{DisableKeepAlives: true},
+			exp: TransportStats{
+				OpenConns: 0,
+				Dials:     3,
+				Requests:  3,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newOptions([]Option{WithTransportOptions(tt.transportOptions)}).newTransport()
+			client := &http.Client{Transport: transport}
+			for i := 0; i < 3; i++ {
+				resp, err := client.Get(server.URL)
+				assert.NoError(t, err)
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			// closing the connection after the response is asynchronous
+			assert.Eventually(t, func() bool { return transport.Stats() == tt.exp }, time.Second, 10*time.Millisecond)
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package balancer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUpgradeGracePeriod is how long the upgraded connections of a draining instance are kept open
+	defaultUpgradeGracePeriod = 30 * time.Second
+	// closeTimeout bounds the WebSocket closing handshake after the close frame is sent
+	closeTimeout = 5 * time.Second
+)
+
+// closeGoingAway is the WebSocket close frame with the status 1001 going away
+var closeGoingAway = []byte{0x88, 0x02, 0x03, 0xE9}
+
+// IsUpgrade reports whether the request asks to switch protocols, e.g., to open a WebSocket
+func IsUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrades tracks the upgraded connections of an instance
+type upgrades struct {
+	gracePeriod time.Duration
+
+	mu    sync.Mutex
+	conns map[*upgradedConn]struct{}
+}
+
+func newUpgrades(gracePeriod time.Duration) *upgrades {
+	if gracePeriod <= 0 {
+		gracePeriod = defaultUpgradeGracePeriod
+	}
+	return &upgrades{gracePeriod: gracePeriod, conns: map[*upgradedConn]struct{}{}}
+}
+
+// count returns the number of open upgraded connections
+func (u *upgrades) count() int {
+	if u == nil {
+		return 0
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.conns)
+}
+
+func (u *upgrades) add(c *upgradedConn) {
+	u.mu.Lock()
+	u.conns[c] = struct{}{}
+	u.mu.Unlock()
+}
+
+func (u *upgrades) remove(c *upgradedConn) {
+	u.mu.Lock()
+	delete(u.conns, c)
+	u.mu.Unlock()
+}
+
+// goAway closes all upgraded connections, WebSockets are sent a going away close frame first
+func (u *upgrades) goAway() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	conns := make([]*upgradedConn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	u.mu.Unlock()
+	for _, c := range conns {
+		c.goAway()
+	}
+}
+
+// goAwayAfterGrace closes the upgraded connections after the grace period if draining still returns true
+func (u *upgrades) goAwayAfterGrace(draining func() bool) {
+	if u == nil {
+		return
+	}
+	time.AfterFunc(u.gracePeriod, func() {
+		if draining() {
+			u.goAway()
+		}
+	})
+}
+
+// upgradeWriter wraps the response of an upgrade request so the hijacked connection is tracked by the instance
+type upgradeWriter struct {
+	http.ResponseWriter
+	upgrades  *upgrades
+	websocket bool
+}
+
+// Hijack implements http.Hijacker
+func (w *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the read and write timeouts of the listener are meant for requests, not long-lived connections
+	conn.SetDeadline(time.Time{})
+	c := &upgradedConn{Conn: conn, upgrades: w.upgrades}
+	if w.websocket {
+		c.frames = &frameScanner{}
+	}
+	w.upgrades.add(c)
+	return c, brw, nil
+}
+
+// Unwrap lets http.ResponseController reach the Flusher of the underlying writer
+func (w *upgradeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// upgradedConn is the client side of an upgraded connection. The writes from the instance are followed
+// frame by frame for WebSockets, so the close frame is never sent in the middle of a frame.
+type upgradedConn struct {
+	net.Conn
+	upgrades *upgrades
+
+	mu sync.Mutex
+	// frames is nil if the connection is not a WebSocket
+	frames *frameScanner
+	// closing is set once the connection should go away, closeSent once the close frame is sent
+	closing   bool
+	closeSent bool
+	closeOnce sync.Once
+}
+
+// Write implements net.Conn
+func (c *upgradedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frames == nil {
+		return c.Conn.Write(p)
+	}
+	if c.closeSent {
+		// the frames of the instance after the close frame are dropped
+		return len(p), nil
+	}
+	end := c.frames.advance(p)
+	if !c.closing || end < 0 {
+		return c.Conn.Write(p)
+	}
+	// send the close frame right after the frame the instance was writing when the connection started going away
+	if _, err := c.Conn.Write(p[:end]); err != nil {
+		return 0, err
+	}
+	return len(p), c.writeClose()
+}
+
+// Close implements net.Conn
+func (c *upgradedConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.upgrades.remove(c)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// goAway sends the going away close frame to a WebSocket client, at once or at the end of the current frame,
+// then gives the client closeTimeout to answer. Other upgraded connections are closed right away.
+func (c *upgradedConn) goAway() {
+	if c.frames == nil {
+		c.Close()
+		return
+	}
+	// bound the closing handshake, which also unblocks a write stuck on a slow client
+	c.Conn.SetDeadline(time.Now().Add(closeTimeout))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return
+	}
+	c.closing = true
+	if c.frames.atBoundary() {
+		if err := c.writeClose(); err != nil {
+			log.Printf("failed to send the close frame to %s with error: %s\n", c.RemoteAddr(), err.Error())
+		}
+	}
+}
+
+func (c *upgradedConn) writeClose() error {
+	c.closeSent = true
+	_, err := c.Conn.Write(closeGoingAway)
+	return err
+}
+
+// frameScanner follows the boundaries of the WebSocket frames written to the client
+type frameScanner struct {
+	// header holds the bytes of a frame header split across writes
+	header []byte
+	// remaining is the number of payload bytes of the current frame not written yet
+	remaining uint64
+}
+
+// advance consumes p and returns the offset in p right after the first frame ending in it, -1 if none does
+func (s *frameScanner) advance(p []byte) int {
+	end := -1
+	for i := 0; i < len(p); {
+		if s.remaining > 0 {
+			n := uint64(len(p) - i)
+			if n > s.remaining {
+				n = s.remaining
+			}
+			s.remaining -= n
+			i += int(n)
+		} else {
+			s.header = append(s.header, p[i])
+			i++
+			if !s.parseHeader() {
+				continue
+			}
+		}
+		if end < 0 && s.atBoundary() {
+			end = i
+		}
+	}
+	return end
+}
+
+// parseHeader reads the payload length once the header is complete, it returns false if more bytes are needed
+func (s *frameScanner) parseHeader() bool {
+	if len(s.header) < 2 {
+		return false
+	}
+	size := 2
+	length := uint64(s.header[1] & 0x7F)
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if s.header[1]&0x80 != 0 {
+		// the masking key
+		size += 4
+	}
+	if len(s.header) < size {
+		return false
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(s.header[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(s.header[2:10])
+	}
+	s.remaining = length
+	s.header = s.header[:0]
+	return true
+}
+
+// atBoundary reports whether the last frame is complete
+func (s *frameScanner) atBoundary() bool {
+	return len(s.header) == 0 && s.remaining == 0
+}
@@ -0,0 +1,195 @@
+package balancer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		exp     bool
+	}{
+		{
+			name:    "websocket",
+			headers: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"},
+			exp:     true,
+		},
+		{
+			name:    "upgrade among the connection tokens",
+			headers: map[string]string{"Connection": "keep-alive, upgrade", "Upgrade": "websocket"},
+			exp:     true,
+		},
+		{
+			name:    "no upgrade header",
+			headers: map[string]string{"Connection": "Upgrade"},
+			exp:     false,
+		},
+		{
+			name:    "no upgrade connection token",
+			headers: map[string]string{"Connection": "keep-alive", "Upgrade": "websocket"},
+			exp:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.exp, IsUpgrade(r))
+		})
+	}
+}
+
+func TestFrameScannerAdvance(t *testing.T) {
+	t.Parallel()
+
+	long := make([]byte, 4+300)
+	long[0], long[1], long[2], long[3] = 0x82, 126, 0x01, 0x2C
+
+	tests := []struct {
+		name   string
+		writes [][]byte
+		exp    []int
+	}{
+		{
+			name:   "whole frames",
+			writes: [][]byte{{0x81, 0x02, 'h', 'i', 0x81, 0x00}},
+			exp:    []int{4},
+		},
+		{
+			name:   "header split across writes",
+			writes: [][]byte{{0x81}, {0x02, 'h'}, {'i', 0x81}},
+			exp:    []int{-1, -1, 1},
+		},
+		{
+			name:   "16 bit payload length",
+			writes: [][]byte{long[:100], long[100:]},
+			exp:    []int{-1, 204},
+		},
+		{
+			name:   "masked frame",
+			writes: [][]byte{{0x81, 0x82, 1, 2, 3, 4, 'h', 'i'}},
+			exp:    []int{8},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &frameScanner{}
+			for i, p := range tt.writes {
+				assert.Equal(t, tt.exp[i], s.advance(p))
+			}
+		})
+	}
+}
+
+func TestUpgradedConnGoAwayMidFrame(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(client)
+		received <- b
+	}()
+
+	c := &upgradedConn{Conn: server, upgrades: newUpgrades(0), frames: &frameScanner{}}
+	c.upgrades.add(c)
+	c.Write([]byte{0x81, 0x05, 'h', 'e'})
+	// the close frame waits for the end of the frame, the next frame is dropped
+	c.goAway()
+	c.Write([]byte{'l', 'l', 'o', 0x81, 0x02})
+	c.Write([]byte{'h', 'i'})
+	c.Close()
+
+	exp := append([]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'}, closeGoingAway...)
+	assert.Equal(t, exp, <-received)
+	assert.Equal(t, 0, c.upgrades.count())
+}
+
+func TestRoundRobinWebSocket(t *testing.T) {
+	t.Parallel()
+
+	// a WebSocket server sending one text frame, then waiting for the proxy to close the connection
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Write([]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'})
+		brw.Flush()
+		io.Copy(io.Discard, conn)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name   string
+		goAway func(rr *RoundRobin)
+	}{
+		{
+			name:   "drain",
+			goAway: func(rr *RoundRobin) { rr.SetDraining(backend.URL, true) },
+		},
+		{
+			name:   "shutdown",
+			goAway: func(rr *RoundRobin) { go rr.Shutdown() },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := NewRoundRobin([]string{backend.URL}, 5, WithName("websocket-"+tt.name), WithUpgradeGracePeriod(50*time.Millisecond))
+			assert.NoError(t, err)
+			frontend := httptest.NewServer(rr)
+			defer frontend.Close()
+
+			conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+			assert.NoError(t, err)
+			defer conn.Close()
+			fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+			frame := make([]byte, 7)
+			_, err = io.ReadFull(br, frame)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(frame[2:]))
+			// the upgraded connection counts toward the load of the instance
+			stats := rr.Stats().Instances[0]
+			assert.Equal(t, int64(1), stats.InFlight)
+			assert.Equal(t, 1, stats.Upgraded)
+
+			tt.goAway(rr)
+			closeFrame := make([]byte, len(closeGoingAway))
+			_, err = io.ReadFull(br, closeFrame)
+			assert.NoError(t, err)
+			assert.Equal(t, closeGoingAway, closeFrame)
+
+			// the client ends the closing handshake by closing the connection
+			conn.Close()
+			assert.Eventually(t, func() bool {
+				stats := rr.Stats().Instances[0]
+				return stats.InFlight == 0 && stats.Upgraded == 0
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
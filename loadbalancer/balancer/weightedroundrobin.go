@@ -1,12 +1,11 @@
 package balancer
 
 import (
+	"context"
 	"errors"
 	"log"
 	"math"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,53 +18,79 @@ type WeightedRoundRobin struct {
 	healthCheckIntervalInSeconds int
 	weights                      []uint16
 	mu                           sync.RWMutex
+	transport                    *statsTransport
+	// queue is nil if the wait queue is disabled
+	queue *waitQueue
+	// failover is nil if the pool has no backup instances
+	failover *failover
+	// locality is nil if the zone aware routing is disabled
+	locality *locality
+	// upgradeGracePeriod is how long Shutdown waits for the upgraded connections to end
+	upgradeGracePeriod time.Duration
 }
 
 // NewWeightedRoundRobin new a WeightedRoundRobin balancer
-func NewWeightedRoundRobin(urls []string, healthCheckIntervalInSeconds int) (*WeightedRoundRobin, error) {
+func NewWeightedRoundRobin(urls []string, healthCheckIntervalInSeconds int, opts ...Option) (*WeightedRoundRobin, error) {
 	if len(urls) == 0 {
 		return nil, errors.New("the input url list is empty")
 	}
+	o := newOptions(opts)
+	transport := o.newTransport()
 	instances := []WRRInstance{}
+	hasBackups := false
 	for _, u := range urls {
-		instanceURL, err := url.Parse(u)
-		if err != nil {
-			log.Printf("failed to parse url:%s with error: %s\n", u, err.Error())
-			return nil, err
-		}
-		proxy := httputil.NewSingleHostReverseProxy(instanceURL)
-		instances = append(instances, &WRRInstanceImpl{
-			RRInstanceImpl: RRInstanceImpl{
-				URL:          instanceURL,
-				ReverseProxy: proxy,
-				alive:        true,
-			},
+		instance := &WRRInstanceImpl{
 			alpha:       0.7,
 			ewmaLatency: 1,
-		})
+		}
+		if err := instance.init(u, transport, o); err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+		hasBackups = hasBackups || instance.IsBackup()
 	}
-	return &WeightedRoundRobin{
+	wrr := &WeightedRoundRobin{
 		instances:                    instances,
 		current:                      0,
 		healthCheckIntervalInSeconds: healthCheckIntervalInSeconds,
-	}, nil
+		transport:                    transport,
+		failover:                     newFailover(o, hasBackups),
+		locality:                     newLocality(o),
+		upgradeGracePeriod:           o.upgradeGracePeriod,
+	}
+	if o.queue != nil {
+		wrr.queue = newWaitQueue(*o.queue)
+	}
+	publishStats(o.name, wrr.Stats)
+	return wrr, nil
 }
 
 const MaxWeight = math.MaxUint16
 
 // ServeHTTP implements http.Handler
 func (wrr *WeightedRoundRobin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	next, err := wrr.next()
+	next, generation, err := wrr.acquire(r.Context())
 	if err != nil {
-		log.Printf("failed to find any alive instance")
-		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Printf("failed to acquire an instance with error: %s\n", err.Error())
+		w.WriteHeader(acquireErrorStatus(err))
 		return
 	}
 
+	rec := NewStatusRecorder(w)
+	var responseTime int64
+	defer func() {
+		// the same latency sample feeds the circuit breaker and the adaptive limiter
+		if !rec.Counted() {
+			wrr.instances[next].Discard(generation)
+		} else {
+			wrr.instances[next].Release(generation, rec.Succeeded(), time.Duration(responseTime))
+		}
+		wrr.queue.notify()
+	}()
 	startTime := time.Now()
-	wrr.instances[next].ServeHTTP(w, r)
+	wrr.instances[next].ServeHTTP(rec, r)
 
-	responseTime := time.Since(startTime).Nanoseconds()
+	responseTime = rec.Elapsed(startTime).Nanoseconds()
 	wrr.instances[next].SetEWMALatency(responseTime)
 
 	// log instance index for demo
@@ -73,22 +98,70 @@ func (wrr *WeightedRoundRobin) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	log.Printf("instance: %d, responseTime: %d\n", next, responseTime)
 }
 
-// next decides which instanceIndex the balancer should send the next request to
-func (wrr *WeightedRoundRobin) next() (uint64, error) {
+// Pick picks and acquires an instance for a request or a connection not served by ServeHTTP, e.g., in TCP mode.
+// The returned release must be called with the result and the latency once it's done, the latency also feeds the EWMA latency.
+func (wrr *WeightedRoundRobin) Pick(ctx context.Context) (RRInstance, func(success bool, latency time.Duration), error) {
+	next, generation, err := wrr.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	instance := wrr.instances[next]
+	return instance, func(success bool, latency time.Duration) {
+		instance.SetEWMALatency(latency.Nanoseconds())
+		instance.Release(generation, success, latency)
+		wrr.queue.notify()
+	}, nil
+}
+
+// acquire picks and acquires an instance, waiting in the queue until ctx is done if all alive instances are busy
+// or other requests are already waiting. The circuit generation of the instance is passed on to Release.
+func (wrr *WeightedRoundRobin) acquire(ctx context.Context) (uint64, uint64, error) {
+	if wrr.queue == nil {
+		return wrr.next()
+	}
+	var next, generation uint64
+	err := wrr.queue.acquire(ctx, func() error {
+		var err error
+		next, generation, err = wrr.next()
+		return err
+	})
+	return next, generation, err
+}
+
+// next decides which instanceIndex the balancer should send the next request to.
+// The picked instance is acquired and must be released with the returned circuit generation once the request is done.
+func (wrr *WeightedRoundRobin) next() (uint64, uint64, error) {
+	s := newSelection(len(wrr.instances), func(i int) RRInstance { return wrr.instances[i] }, wrr.failover, wrr.locality)
+	instanceIdx, generation, err := wrr.pick(false, s)
+	if errors.Is(err, errSlowStartSkipped) {
+		// the available instances were all skipped while slow starting, pick one with their full weight
+		return wrr.pick(true, s)
+	}
+	return instanceIdx, generation, err
+}
+
+// pick loops the instances once from the current position, the weights of the instances in slow start
+// are scaled down by their slow start factor unless ignoreSlowStart, instances out of the selection s are skipped
+func (wrr *WeightedRoundRobin) pick(ignoreSlowStart bool, s selection) (uint64, uint64, error) {
 	wrr.mu.RLock()
 	defer wrr.mu.RUnlock()
 
 	length := uint64(len(wrr.weights))
 	if length == 0 {
-		return 0, errors.New("weight list is empty")
+		return 0, 0, errors.New("weight list is empty")
 	}
 
 	// loop to find an alive instance and retry no more than `length` times
+	unavailable := unavailableInstances{}
 	for i := uint64(0); i < length; i++ {
 		next := uint64(atomic.AddUint32(&wrr.current, 1))
 		instanceIdx := next % length
 		// get instance's weight
 		weight := uint64(wrr.weights[instanceIdx])
+		slowStartWeight := weight
+		if factor := wrr.instances[instanceIdx].SlowStartFactor(); !ignoreSlowStart && factor < 1 {
+			slowStartWeight = uint64(float64(weight) * factor)
+		}
 
 		// Found out which `round` we are running
 		round := next / length
@@ -101,13 +174,24 @@ func (wrr *WeightedRoundRobin) next() (uint64, error) {
 		if mod > weight {
 			continue
 		}
-		if !wrr.instances[instanceIdx].IsAlive() {
+		if !isAvailable(wrr.instances[instanceIdx]) {
 			continue
 		}
-		return instanceIdx, nil
+		if !s.allows(wrr.instances[instanceIdx]) {
+			continue
+		}
+		if mod > slowStartWeight {
+			unavailable.slowStartSkipped = true
+			continue
+		}
+		generation, err := wrr.instances[instanceIdx].Acquire()
+		if err != nil {
+			unavailable.add(err)
+			continue
+		}
+		return instanceIdx, generation, nil
 	}
-	// all registered instances are not alive
-	return 0, errors.New("failed to find any alive instance")
+	return 0, 0, unavailable.err()
 }
 
 // HealthCheck run a round of health check on its instances and recalculate the balancer.weights list
@@ -154,6 +238,49 @@ func (wrr *WeightedRoundRobin) GetHealthCheckInterval() int {
 	return wrr.healthCheckIntervalInSeconds
 }
 
+// SetDraining drains the instance with the url or puts it back in rotation
+func (wrr *WeightedRoundRobin) SetDraining(url string, draining bool) error {
+	return setDraining(wrr.rrInstances(), url, draining)
+}
+
+// Shutdown waits up to the upgrade grace period for the upgraded connections to end,
+// then closes the remaining ones, sending a close frame to the WebSockets
+func (wrr *WeightedRoundRobin) Shutdown() {
+	shutdownUpgraded(wrr.rrInstances(), wrr.upgradeGracePeriod)
+}
+
+// rrInstances returns the instances as RRInstances
+func (wrr *WeightedRoundRobin) rrInstances() []RRInstance {
+	instances := make([]RRInstance, len(wrr.instances))
+	for i, instance := range wrr.instances {
+		instances[i] = instance
+	}
+	return instances
+}
+
+// QueueWait returns how long the oldest request in the wait queue has waited, 0 if none is waiting
+func (wrr *WeightedRoundRobin) QueueWait() time.Duration {
+	return wrr.queue.oldestWait()
+}
+
+// Stats returns a snapshot of the pool state
+func (wrr *WeightedRoundRobin) Stats() PoolStats {
+	stats := PoolStats{}
+	if wrr.transport != nil {
+		stats.Transport = wrr.transport.Stats()
+	}
+	for _, instance := range wrr.instances {
+		stats.Instances = append(stats.Instances, instance.Stats())
+	}
+	if wrr.queue != nil {
+		queue := wrr.queue.Stats()
+		stats.Queue = &queue
+	}
+	stats.Failover = wrr.failover.isActive()
+	stats.ZoneSpillover = wrr.locality.isSpillover()
+	return stats
+}
+
 // WRRInstance decorate the RRInstance interface with new functionality
 type WRRInstance interface {
 	RRInstance
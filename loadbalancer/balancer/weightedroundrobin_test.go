@@ -139,6 +139,43 @@ func TestWeightedRoundRobinNext(t *testing.T) {
 			exp:    2,
 			expErr: nil,
 		},
+		{
+			name: "skip open circuit instance",
+			weightedRoundRobin: &WeightedRoundRobin{
+				instances: []WRRInstance{
+					&WRRInstanceImpl{
+						RRInstanceImpl: RRInstanceImpl{
+							URL:   url8081,
+							alive: true,
+						},
+						alpha:       0.7,
+						ewmaLatency: 100,
+					},
+					&WRRInstanceImpl{
+						RRInstanceImpl: RRInstanceImpl{
+							URL:     url8082,
+							alive:   true,
+							breaker: openCircuitBreaker(),
+						},
+						alpha:       0.7,
+						ewmaLatency: 100,
+					},
+					&WRRInstanceImpl{
+						RRInstanceImpl: RRInstanceImpl{
+							URL:   url8083,
+							alive: true,
+						},
+						alpha:       0.7,
+						ewmaLatency: 100,
+					},
+				},
+				current:                      30, // next = 31 % 3 = 1
+				healthCheckIntervalInSeconds: 5,
+				weights:                      []uint16{65535, 65535, 65535},
+			},
+			exp:    2,
+			expErr: nil,
+		},
 		{
 			name: "no alive instance",
 			weightedRoundRobin: &WeightedRoundRobin{
@@ -179,7 +216,7 @@ func TestWeightedRoundRobinNext(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			next, err := tt.weightedRoundRobin.next()
+			next, _, err := tt.weightedRoundRobin.next()
 			if tt.expErr != nil {
 				assert.EqualError(t, err, tt.expErr.Error())
 			} else {
@@ -0,0 +1,305 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSamples is the number of latency samples a window keeps per variant, the p99 is taken from a uniform sample beyond it
+const maxSamples = 10000
+
+// maxDecisions is the number of decisions kept in the audit log
+const maxDecisions = 100
+
+// actions of the decisions
+const (
+	// ActionHold keeps the canary share, the window doesn't have enough requests yet
+	ActionHold = "hold"
+	// ActionPromote raises the canary share to the next step
+	ActionPromote = "promote"
+	// ActionComplete ends the analysis after the last step passed or the canary is promoted to 100%, the canary keeps its share
+	ActionComplete = "complete"
+	// ActionRollback ends the analysis with the canary share set to 0
+	ActionRollback = "rollback"
+)
+
+// Weighter is the traffic split the canary share is set on
+type Weighter interface {
+	SetWeights(weights map[string]float64) error
+}
+
+// Policy holds the steps of the canary share and the thresholds of the canary against the baseline
+type Policy struct {
+	// Baseline and Canary are the variant names in the split
+	Baseline string
+	Canary   string
+	// Steps are the canary shares in percent, the analysis starts at the first one.
+	// Only the last step may be 100, the analysis completes once it's reached since the baseline takes no traffic anymore.
+	Steps []float64
+	// Interval is how long the requests of a window are collected before a decision, default 1m
+	Interval time.Duration
+	// MinRequests is the number of requests each variant needs in a window before a decision, default 100
+	MinRequests int64
+	// MaxErrorRateIncrease is how much the canary error rate may exceed the baseline's, e.g., 0.01 for 1 percentage point, default 0.01
+	MaxErrorRateIncrease float64
+	// MaxLatencyRatio is how many times the baseline p99 latency the canary p99 latency may be, default 1.2
+	MaxLatencyRatio float64
+}
+
+// WindowStats is the result of a variant over a window
+type WindowStats struct {
+	Requests  int64         `json:"requests"`
+	ErrorRate float64       `json:"errorRate"`
+	P99       time.Duration `json:"p99Ns"`
+}
+
+// Decision is an entry of the audit log
+type Decision struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Weight is the canary share in percent after the decision
+	Weight   float64     `json:"weight"`
+	Reason   string      `json:"reason"`
+	Canary   WindowStats `json:"canary"`
+	Baseline WindowStats `json:"baseline"`
+}
+
+// Status is a snapshot of the analysis
+type Status struct {
+	Weight float64 `json:"weight"`
+	// Done is true once the analysis completed or rolled back
+	Done      bool       `json:"done"`
+	Decisions []Decision `json:"decisions"`
+}
+
+// window collects the results of a variant
+type window struct {
+	requests int64
+	errors   int64
+	samples  []time.Duration
+}
+
+func (w *window) add(failed bool, latency time.Duration) {
+	w.requests++
+	if failed {
+		w.errors++
+	}
+	if len(w.samples) < maxSamples {
+		w.samples = append(w.samples, latency)
+		return
+	}
+	// reservoir sampling keeps a uniform sample of all latencies
+	if i := rand.Int63n(w.requests); i < maxSamples {
+		w.samples[i] = latency
+	}
+}
+
+func (w *window) stats() WindowStats {
+	stats := WindowStats{Requests: w.requests}
+	if w.requests == 0 {
+		return stats
+	}
+	stats.ErrorRate = float64(w.errors) / float64(w.requests)
+	sorted := append([]time.Duration{}, w.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.P99 = sorted[len(sorted)*99/100]
+	return stats
+}
+
+// Analyzer compares the canary of a split against its baseline over windows of requests,
+// raising the canary share step by step or rolling it back to 0
+type Analyzer struct {
+	name     string
+	policy   Policy
+	splitter Weighter
+	now      func() time.Time
+
+	mu   sync.Mutex
+	step int
+	// weight is the canary share in percent
+	weight    float64
+	done      bool
+	windows   map[string]*window
+	decisions []Decision
+}
+
+// NewAnalyzer new an Analyzer of the split, the canary share is set to the first step right away
+func NewAnalyzer(name string, splitter Weighter, policy Policy) (*Analyzer, error) {
+	if policy.Baseline == "" || policy.Canary == "" || policy.Baseline == policy.Canary {
+		return nil, fmt.Errorf("canary %s needs a baseline and a canary variant", name)
+	}
+	if len(policy.Steps) == 0 {
+		return nil, fmt.Errorf("canary %s has no steps", name)
+	}
+	for i, step := range policy.Steps {
+		if step <= 0 || step > 100 {
+			return nil, errors.New("the canary steps must be in (0, 100]")
+		}
+		if step == 100 && (i == 0 || i != len(policy.Steps)-1) {
+			return nil, errors.New("only the last canary step may be 100, the baseline needs traffic to compare against")
+		}
+	}
+	if policy.Interval <= 0 {
+		policy.Interval = time.Minute
+	}
+	if policy.MinRequests <= 0 {
+		policy.MinRequests = 100
+	}
+	if policy.MaxErrorRateIncrease <= 0 {
+		policy.MaxErrorRateIncrease = 0.01
+	}
+	if policy.MaxLatencyRatio <= 0 {
+		policy.MaxLatencyRatio = 1.2
+	}
+	a := &Analyzer{
+		name:     name,
+		policy:   policy,
+		splitter: splitter,
+		now:      time.Now,
+		windows:  map[string]*window{},
+	}
+	a.resetWindows()
+	if err := a.setWeight(policy.Steps[0]); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Observe records the result of a request sent to a variant, the requests of other variants are ignored
+func (a *Analyzer) Observe(variant string, failed bool, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if w, ok := a.windows[variant]; ok && !a.done {
+		w.add(failed, latency)
+	}
+}
+
+// Run evaluates a window every interval until the analysis is done or ctx is canceled
+func (a *Analyzer) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if decision := a.Evaluate(); decision.Action == ActionComplete || decision.Action == ActionRollback {
+				return
+			}
+		}
+	}
+}
+
+// Evaluate decides on the window collected since the last decision and records the decision in the audit log.
+// A window without enough requests is held and keeps collecting.
+func (a *Analyzer) Evaluate() Decision {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	canary := a.windows[a.policy.Canary].stats()
+	baseline := a.windows[a.policy.Baseline].stats()
+	decision := Decision{
+		Time:     a.now(),
+		Weight:   a.weight,
+		Canary:   canary,
+		Baseline: baseline,
+	}
+	switch {
+	case a.done:
+		decision.Action = ActionHold
+		decision.Reason = "the analysis is done"
+		return decision
+	case canary.Requests < a.policy.MinRequests || baseline.Requests < a.policy.MinRequests:
+		decision.Action = ActionHold
+		decision.Reason = fmt.Sprintf("each variant needs %d requests", a.policy.MinRequests)
+	case canary.ErrorRate > baseline.ErrorRate+a.policy.MaxErrorRateIncrease:
+		decision.Action = ActionRollback
+		decision.Reason = fmt.Sprintf("canary error rate %.4f exceeds baseline error rate %.4f by more than %.4f",
+			canary.ErrorRate, baseline.ErrorRate, a.policy.MaxErrorRateIncrease)
+	case float64(canary.P99) > float64(baseline.P99)*a.policy.MaxLatencyRatio:
+		decision.Action = ActionRollback
+		decision.Reason = fmt.Sprintf("canary p99 %s exceeds %.2f times baseline p99 %s",
+			canary.P99, a.policy.MaxLatencyRatio, baseline.P99)
+	case a.step == len(a.policy.Steps)-1:
+		decision.Action = ActionComplete
+		decision.Reason = "the last step passed"
+	default:
+		decision.Action = ActionPromote
+		decision.Reason = "the canary is within the thresholds"
+	}
+
+	switch decision.Action {
+	case ActionRollback:
+		a.done = true
+		if err := a.setWeight(0); err != nil {
+			decision.Reason += ", failed to set the weights: " + err.Error()
+		}
+	case ActionComplete:
+		a.done = true
+	case ActionPromote:
+		a.step++
+		if a.policy.Steps[a.step] == 100 {
+			// the baseline takes no traffic at 100%, so there is nothing left to compare against
+			decision.Action = ActionComplete
+			decision.Reason = "the canary is within the thresholds and takes all the traffic"
+			a.done = true
+		}
+		if err := a.setWeight(a.policy.Steps[a.step]); err != nil {
+			decision.Reason += ", failed to set the weights: " + err.Error()
+		}
+	}
+	if decision.Action != ActionHold {
+		a.resetWindows()
+	}
+	decision.Weight = a.weight
+	a.record(decision)
+	return decision
+}
+
+// Status returns the canary share and the audit log
+func (a *Analyzer) Status() Status {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return Status{
+		Weight:    a.weight,
+		Done:      a.done,
+		Decisions: append([]Decision{}, a.decisions...),
+	}
+}
+
+// setWeight sets the canary share in percent, the baseline takes the rest
+func (a *Analyzer) setWeight(weight float64) error {
+	a.weight = weight
+	log.Printf("canary %s weight set to %.2f%%", a.name, weight)
+	return a.splitter.SetWeights(map[string]float64{
+		a.policy.Canary:   weight,
+		a.policy.Baseline: 100 - weight,
+	})
+}
+
+func (a *Analyzer) resetWindows() {
+	a.windows[a.policy.Canary] = &window{}
+	a.windows[a.policy.Baseline] = &window{}
+}
+
+// record appends the decision to the audit log, a hold repeating the last decision replaces it
+// so the holds of a window don't push the promotions and rollbacks out of the log
+func (a *Analyzer) record(decision Decision) {
+	if n := len(a.decisions); n > 0 && decision.Action == ActionHold {
+		if last := a.decisions[n-1]; last.Action == ActionHold && last.Weight == decision.Weight && last.Reason == decision.Reason {
+			a.decisions[n-1] = decision
+			return
+		}
+	}
+	log.Printf("canary %s %s at %.2f%%: %s", a.name, decision.Action, decision.Weight, decision.Reason)
+	a.decisions = append(a.decisions, decision)
+	if len(a.decisions) > maxDecisions {
+		a.decisions = a.decisions[len(a.decisions)-maxDecisions:]
+	}
+}
@@ -0,0 +1,192 @@
+package canary
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSplitter records the weights set on it
+type fakeSplitter struct {
+	weights map[string]float64
+}
+
+func (s *fakeSplitter) SetWeights(weights map[string]float64) error {
+	s.weights = weights
+	return nil
+}
+
+// observe sends n requests to the variant, the first failures of them failing
+func observe(a *Analyzer, variant string, n int, failures int, latency time.Duration) {
+	for i := 0; i < n; i++ {
+		a.Observe(variant, i < failures, latency)
+	}
+}
+
+func TestAnalyzerEvaluate(t *testing.T) {
+	t.Parallel()
+
+	policy := Policy{
+		Baseline:    "stable",
+		Canary:      "canary",
+		Steps:       []float64{5, 50},
+		MinRequests: 100,
+	}
+
+	tests := []struct {
+		name       string
+		canary     func(a *Analyzer)
+		expActions []string
+		expWeight  float64
+	}{
+		{
+			name: "healthy canary is promoted to the last step",
+			canary: func(a *Analyzer) {
+				observe(a, "canary", 100, 1, 10*time.Millisecond)
+			},
+			expActions: []string{ActionPromote, ActionComplete},
+			expWeight:  50,
+		},
+		{
+			name: "canary with more errors is rolled back",
+			canary: func(a *Analyzer) {
+				observe(a, "canary", 100, 5, 10*time.Millisecond)
+			},
+			expActions: []string{ActionRollback, ActionHold},
+			expWeight:  0,
+		},
+		{
+			name: "slower canary is rolled back",
+			canary: func(a *Analyzer) {
+				observe(a, "canary", 100, 1, 20*time.Millisecond)
+			},
+			expActions: []string{ActionRollback, ActionHold},
+			expWeight:  0,
+		},
+		{
+			name: "canary without enough requests is held",
+			canary: func(a *Analyzer) {
+				observe(a, "canary", 10, 0, 10*time.Millisecond)
+			},
+			expActions: []string{ActionHold, ActionHold},
+			expWeight:  5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			splitter := &fakeSplitter{}
+			a, err := NewAnalyzer("test", splitter, policy)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]float64{"canary": 5, "stable": 95}, splitter.weights)
+
+			actions := []string{}
+			for i := 0; i < 2; i++ {
+				observe(a, "stable", 1000, 10, 10*time.Millisecond)
+				tt.canary(a)
+				actions = append(actions, a.Evaluate().Action)
+			}
+			assert.Equal(t, tt.expActions, actions)
+			assert.Equal(t, tt.expWeight, splitter.weights["canary"])
+			assert.Equal(t, 100-tt.expWeight, splitter.weights["stable"])
+
+			status := a.Status()
+			assert.Equal(t, tt.expWeight, status.Weight)
+			// the decisions after the analysis is done are not recorded
+			assert.LessOrEqual(t, len(status.Decisions), 2)
+		})
+	}
+}
+
+func TestAnalyzerCompletesAt100(t *testing.T) {
+	t.Parallel()
+
+	splitter := &fakeSplitter{}
+	a, err := NewAnalyzer("test", splitter, Policy{
+		Baseline:    "stable",
+		Canary:      "canary",
+		Steps:       []float64{5, 50, 100},
+		MinRequests: 100,
+	})
+	assert.NoError(t, err)
+
+	actions := []string{}
+	for i := 0; i < 2; i++ {
+		observe(a, "stable", 1000, 10, 10*time.Millisecond)
+		observe(a, "canary", 100, 1, 10*time.Millisecond)
+		actions = append(actions, a.Evaluate().Action)
+	}
+	// the promotion to 100% ends the analysis, the baseline gets no traffic to compare against
+	assert.Equal(t, []string{ActionPromote, ActionComplete}, actions)
+	assert.Equal(t, map[string]float64{"canary": 100, "stable": 0}, splitter.weights)
+	assert.True(t, a.Status().Done)
+}
+
+func TestAnalyzerRepeatedHolds(t *testing.T) {
+	t.Parallel()
+
+	a, err := NewAnalyzer("test", &fakeSplitter{}, Policy{Baseline: "stable", Canary: "canary", Steps: []float64{5, 50}})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		a.Evaluate()
+	}
+	observe(a, "stable", 1000, 10, 10*time.Millisecond)
+	observe(a, "canary", 100, 1, 10*time.Millisecond)
+	a.Evaluate()
+	a.Evaluate()
+
+	// the identical holds are recorded once, the hold after the promotion is a new entry
+	actions := []string{}
+	for _, d := range a.Status().Decisions {
+		actions = append(actions, d.Action)
+	}
+	assert.Equal(t, []string{ActionHold, ActionPromote, ActionHold}, actions)
+}
+
+func TestNewAnalyzerInvalidPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		policy Policy
+	}{
+		{
+			name:   "no steps",
+			policy: Policy{Baseline: "stable", Canary: "canary"},
+		},
+		{
+			name:   "step over 100",
+			policy: Policy{Baseline: "stable", Canary: "canary", Steps: []float64{50, 150}},
+		},
+		{
+			name:   "100 before the last step",
+			policy: Policy{Baseline: "stable", Canary: "canary", Steps: []float64{50, 100, 100}},
+		},
+		{
+			name:   "first step at 100",
+			policy: Policy{Baseline: "stable", Canary: "canary", Steps: []float64{100}},
+		},
+		{
+			name:   "same baseline and canary",
+			policy: Policy{Baseline: "stable", Canary: "stable", Steps: []float64{5}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAnalyzer("test", &fakeSplitter{}, tt.policy)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestWindowP99(t *testing.T) {
+	t.Parallel()
+
+	w := &window{}
+	for i := 1; i <= 1000; i++ {
+		w.add(false, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 991*time.Millisecond, w.stats().P99)
+}
@@ -0,0 +1,544 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the optional JSON configuration file of the load balancer
+type Config struct {
+	// Upstream holds the settings of the default backend pool, whose urls are given by the -urls flag
+	Upstream UpstreamConfig `json:"upstream"`
+	// Pools holds the other backend pools keyed by their names, the routes send traffic to them with a split
+	Pools map[string]PoolConfig `json:"pools"`
+	// Listener holds the settings of the load balancer's own listener
+	Listener ListenerConfig `json:"listener"`
+	// Routes holds the per path prefix settings, see Routes.Match
+	Routes Routes `json:"routes"`
+	// Rules send the requests to pools by their headers, query or path, the first matching rule takes precedence
+	// over the routes' splits and mirrors, the requests matching none go by the routes
+	Rules []RuleConfig `json:"rules"`
+	// RateLimit is the default rate limit of the routes without their own
+	RateLimit *RateLimitConfig `json:"rateLimit"`
+	// LoadShedding sheds the lower priority requests first when the load balancer is saturated
+	LoadShedding *LoadSheddingConfig `json:"loadShedding"`
+}
+
+// RuleConfig holds the conditions of a routing rule, all set conditions must match
+type RuleConfig struct {
+	Headers   map[string]string `json:"headers"`
+	Query     map[string]string `json:"query"`
+	PathRegex string            `json:"pathRegex"`
+	// Body holds the values at JSON paths into the request body, e.g., "game": "Mobile Legends"
+	Body map[string]string `json:"body"`
+	// Pool is the name of the pool the matching requests are sent to, "default" for the pool of the -urls flag
+	Pool string `json:"pool"`
+}
+
+// PoolConfig holds the urls and the upstream settings of a named backend pool
+type PoolConfig struct {
+	URLs []string `json:"urls"`
+	UpstreamConfig
+}
+
+// SplitConfig holds the weighted traffic split of a route between backend pools
+type SplitConfig struct {
+	// Name is the name the split is published and adjusted under in the admin API
+	Name     string          `json:"name"`
+	Variants []VariantConfig `json:"variants"`
+	// Header and Cookie name a request header and a cookie whose value forces the variant of that pool, ignored if empty
+	Header string `json:"header"`
+	Cookie string `json:"cookie"`
+	// Key is the client key a client keeps its variant by, the same keys as RateLimitConfig.Key, default "ip"
+	Key string `json:"key"`
+	// Canary analyzes the canary variant against the baseline and adjusts its weight, the weights are set manually if nil
+	Canary *CanaryConfig `json:"canary"`
+}
+
+// CanaryConfig holds the policy of the canary analysis of a split
+type CanaryConfig struct {
+	// Baseline and Canary are the pools of the variants compared
+	Baseline string `json:"baseline"`
+	Canary   string `json:"canary"`
+	// Steps are the canary weights in percent, the analysis starts at the first one
+	Steps []float64 `json:"steps"`
+	// Interval is how long the requests are collected before each decision, default 1m
+	Interval Duration `json:"interval"`
+	// MinRequests is the number of requests each variant needs before a decision, default 100
+	MinRequests int64 `json:"minRequests"`
+	// MaxErrorRateIncrease is how much the canary error rate may exceed the baseline's, default 0.01
+	MaxErrorRateIncrease float64 `json:"maxErrorRateIncrease"`
+	// MaxLatencyRatio is how many times the baseline p99 latency the canary p99 latency may be, default 1.2
+	MaxLatencyRatio float64 `json:"maxLatencyRatio"`
+}
+
+// HeadersConfig holds the header changes of a route
+type HeadersConfig struct {
+	Request  HeaderRulesConfig `json:"request"`
+	Response HeaderRulesConfig `json:"response"`
+}
+
+// HeaderRulesConfig holds the headers added, set and removed, the values may contain {client_ip}, {backend} and {request_id}
+type HeaderRulesConfig struct {
+	Add    map[string]string `json:"add"`
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+// RewriteConfig holds the URL rewrite or redirect of a route
+type RewriteConfig struct {
+	// PathRegex is replaced by PathReplacement in the path, which may refer to its groups as $1
+	PathRegex       string `json:"pathRegex"`
+	PathReplacement string `json:"pathReplacement"`
+	// StripPrefix is removed from the start of the path, then AddPrefix is prepended
+	StripPrefix string `json:"stripPrefix"`
+	AddPrefix   string `json:"addPrefix"`
+	// Host replaces the Host header sent upstream, or the host of the redirect location
+	Host string `json:"host"`
+	// RedirectStatus answers 301, 302, 307 or 308 with the rewritten URL instead of proxying, zero proxies
+	RedirectStatus int `json:"redirectStatus"`
+	// RedirectScheme is the scheme of the redirect location, the request's by default
+	RedirectScheme string `json:"redirectScheme"`
+}
+
+// MirrorConfig holds the shadow pool the requests of a route are mirrored to
+type MirrorConfig struct {
+	// Pool is the name of the shadow pool
+	Pool string `json:"pool"`
+	// Percent is the share of the requests mirrored, 0 mirrors none, default 100 if unset
+	Percent *float64 `json:"percent"`
+	// MaxBodyBytes is the largest request body mirrored, default 1MB
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+	// Timeout bounds the shadow requests, default 10s
+	Timeout Duration `json:"timeout"`
+	// MaxInFlight is the number of shadow requests in flight beyond which requests are not mirrored, default 100
+	MaxInFlight int64 `json:"maxInFlight"`
+}
+
+// VariantConfig holds the share of a pool in a split
+type VariantConfig struct {
+	// Pool is the name of the pool, "default" for the pool of the -urls flag
+	Pool string `json:"pool"`
+	// Weight is the share of the pool relative to the other variants', e.g., 95 and 5
+	Weight float64 `json:"weight"`
+}
+
+// LoadSheddingConfig holds the priority classes of the requests
+type LoadSheddingConfig struct {
+	// Header is the request header naming the priority class of the requests on routes without a class,
+	// honored only from clients with a verified certificate
+	Header string `json:"header"`
+	// DefaultClass is the class of requests without a header or a route class
+	DefaultClass string                `json:"defaultClass"`
+	Classes      []PriorityClassConfig `json:"classes"`
+}
+
+// PriorityClassConfig holds the load thresholds beyond which the requests of a class are shed
+type PriorityClassConfig struct {
+	Name string `json:"name"`
+	// MaxInFlight sheds the class once the requests in flight through the load balancer reach it, 0 disables it
+	MaxInFlight int64 `json:"maxInFlight"`
+	// MaxQueueWait sheds the class once the oldest request in the wait queue has waited that long, 0 disables it
+	MaxQueueWait Duration `json:"maxQueueWait"`
+}
+
+// RateLimitConfig holds the token bucket settings of a rate limit
+type RateLimitConfig struct {
+	// Key groups the requests sharing a bucket: "ip", "jwt-sub", "route" or "global",
+	// or "header:<name>" for the client identity header of the listener
+	Key string `json:"key"`
+	// JWTSecretFile holds the HS256 secret verifying the JWTs of the "jwt-sub" key
+	JWTSecretFile string `json:"jwtSecretFile"`
+	// Burst is the bucket size
+	Burst int `json:"burst"`
+	// RatePerSecond is the number of tokens refilled per second
+	RatePerSecond float64 `json:"ratePerSecond"`
+}
+
+// listener modes, see ListenerConfig.Mode
+const (
+	// ListenerModeHTTP proxies HTTP requests
+	ListenerModeHTTP = "http"
+	// ListenerModeTCP pipes raw TCP connections to the instances of the default pool
+	ListenerModeTCP = "tcp"
+)
+
+// ListenerConfig holds the settings of the load balancer's listener
+type ListenerConfig struct {
+	// Mode is ListenerModeHTTP or ListenerModeTCP, default http.
+	// In tcp mode the routes, rules and middlewares don't apply, and the listener can't have TLS.
+	Mode string `json:"mode"`
+
+	TLS *ListenerTLSConfig `json:"tls"`
+
+	// timeouts of the http.Server, zero means no timeout except for ReadHeaderTimeout which defaults to 10s,
+	// negative disables it. Routes override ReadTimeout and WriteTimeout for their requests.
+	// In tcp mode IdleTimeout closes the connections idle in both directions, default 5m.
+	ReadTimeout       Duration `json:"readTimeout"`
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	WriteTimeout      Duration `json:"writeTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+
+	// MaxBodyBytes is the default request body limit of all routes, zero means unlimited
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+
+	// H2C serves cleartext HTTP/2 on a listener without TLS, HTTP/2 is always negotiated on the TLS listener
+	H2C bool `json:"h2c"`
+	// MaxConcurrentStreams is the number of concurrent requests of an HTTP/2 connection, default 250
+	MaxConcurrentStreams uint32 `json:"maxConcurrentStreams"`
+}
+
+// ListenerTLSConfig holds the TLS settings of the listener
+type ListenerTLSConfig struct {
+	// CertFile and KeyFile are the server certificate of the load balancer
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ClientCAFile is a PEM bundle used to verify client certificates, client certificates are not requested if empty
+	ClientCAFile string `json:"clientCAFile"`
+	// ClientIdentityHeader is the request header used to forward the verified client identity to the instances
+	ClientIdentityHeader string `json:"clientIdentityHeader"`
+}
+
+// RouteConfig holds the settings of requests whose path starts with PathPrefix
+type RouteConfig struct {
+	PathPrefix string `json:"pathPrefix"`
+	// RequireClientCert rejects requests without a verified client certificate
+	RequireClientCert bool `json:"requireClientCert"`
+	// MaxBodyBytes overrides the listener's request body limit, zero keeps the listener's and negative means unlimited
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+	// ReadTimeout and WriteTimeout override the listener's from the start of the handling of the request,
+	// e.g., longer for uploads, zero keeps the listener's and negative means no timeout
+	ReadTimeout  Duration `json:"readTimeout"`
+	WriteTimeout Duration `json:"writeTimeout"`
+	// UpstreamTimeout bounds the time to get the upstream response, zero means no timeout
+	UpstreamTimeout Duration `json:"upstreamTimeout"`
+	// RateLimit overrides the default rate limit, each route has its own buckets
+	RateLimit *RateLimitConfig `json:"rateLimit"`
+	// Priority is the load shedding priority class of the route
+	Priority string `json:"priority"`
+	// Split sends the traffic of the route to several pools by weight, it goes to the default pool if nil
+	Split *SplitConfig `json:"split"`
+	// Mirror sends a copy of the requests of the route to a shadow pool, discarding its responses
+	Mirror *MirrorConfig `json:"mirror"`
+	// Headers changes the headers of the requests going upstream and of the responses going back
+	Headers *HeadersConfig `json:"headers"`
+	// Rewrite rewrites the URL sent upstream, or redirects the client to it
+	Rewrite *RewriteConfig `json:"rewrite"`
+}
+
+// Routes is the list of route settings
+type Routes []RouteConfig
+
+// Match returns the route with the longest path prefix matching the path, or nil if none matches
+func (rs Routes) Match(path string) *RouteConfig {
+	var matched *RouteConfig
+	for i := range rs {
+		if !hasPathPrefix(path, rs[i].PathPrefix) {
+			continue
+		}
+		if matched == nil || len(rs[i].PathPrefix) > len(matched.PathPrefix) {
+			matched = &rs[i]
+		}
+	}
+	return matched
+}
+
+// hasPathPrefix reports whether the path is the prefix or goes below it, so /admin doesn't match /administrator
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// UpstreamConfig holds the settings applied to all instances of a backend pool
+type UpstreamConfig struct {
+	TLS       *TLSConfig       `json:"tls"`
+	Transport *TransportConfig `json:"transport"`
+	// CircuitBreaker enables a circuit breaker on every instance of the pool
+	CircuitBreaker *CircuitBreakerConfig `json:"circuitBreaker"`
+	// MaxConnections is the default number of concurrent requests an instance takes, 0 means unlimited
+	MaxConnections int `json:"maxConnections"`
+	// Protocol is the default upstream protocol of the instances, "http/1.1", "h2" or "h2c",
+	// empty negotiates HTTP/2 with the https instances and uses HTTP/1.1 otherwise
+	Protocol string `json:"protocol"`
+	// Queue lets requests wait when all alive instances are busy, requests fail with 503 right away if nil
+	Queue *QueueConfig `json:"queue"`
+	// Instances holds the per instance settings
+	Instances []InstanceConfig `json:"instances"`
+	// AdaptiveLimit enables an adaptive concurrency limiter on every instance of the pool
+	AdaptiveLimit *AdaptiveLimitConfig `json:"adaptiveLimit"`
+	// SlowStart ramps up the share of the instances becoming alive again
+	SlowStart *SlowStartConfig `json:"slowStart"`
+	// HealthCheck replaces the TCP health check probe with an HTTP request, which also lets the instances ask to be drained
+	HealthCheck *HealthCheckConfig `json:"healthCheck"`
+	// FailoverThreshold lets the backup instances take traffic when fewer primaries are alive, default 1
+	FailoverThreshold int `json:"failoverThreshold"`
+	// Locality prefers the instances in the zone of the load balancer
+	Locality *LocalityConfig `json:"locality"`
+	// UpgradeGracePeriod is how long the upgraded connections, e.g., WebSockets, are kept open
+	// once their instance drains or the load balancer shuts down, default 30s
+	UpgradeGracePeriod Duration `json:"upgradeGracePeriod"`
+}
+
+// LocalityConfig holds the settings of the zone aware routing
+type LocalityConfig struct {
+	// Zone is the zone of the load balancer
+	Zone string `json:"zone"`
+	// MinLocalPercent is the share of the local instances in percent that must be available to keep the traffic in the zone, default 70
+	MinLocalPercent float64 `json:"minLocalPercent"`
+}
+
+// HealthCheckConfig holds the settings of the HTTP or gRPC health check
+type HealthCheckConfig struct {
+	// Type is "http", the default, or "grpc" to call grpc.health.v1.Health/Check
+	Type string `json:"type"`
+	// Path is requested with GET, 2xx means alive and 503 with "X-Drain: true" means alive but draining
+	Path string `json:"path"`
+	// Service is the service name sent in the gRPC health check, empty checks the whole server
+	Service string `json:"service"`
+	// Timeout bounds the health check request, default 1s
+	Timeout Duration `json:"timeout"`
+}
+
+// SlowStartConfig holds the settings of the slow start of recovered instances
+type SlowStartConfig struct {
+	// Window is how long the share of a recovered instance takes to ramp up to full
+	Window Duration `json:"window"`
+	// MinWeightPercent is the share at the start of the window in percent of the full share, default 10
+	MinWeightPercent float64 `json:"minWeightPercent"`
+	// Aggression shapes the ramp as (elapsed / window) ^ (1 / aggression), default 1 for linear
+	Aggression float64 `json:"aggression"`
+}
+
+// AdaptiveLimitConfig holds the settings of the per instance adaptive concurrency limiters
+type AdaptiveLimitConfig struct {
+	// Algorithm is "aimd" or "gradient", default "gradient"
+	Algorithm string `json:"algorithm"`
+	// InitialLimit, MinLimit and MaxLimit bound the allowed in-flight requests, default 20, 1 and 1000
+	InitialLimit int `json:"initialLimit"`
+	MinLimit     int `json:"minLimit"`
+	MaxLimit     int `json:"maxLimit"`
+	// BackoffRatio multiplies the AIMD limit on a failed or slow request, default 0.9
+	BackoffRatio float64 `json:"backoffRatio"`
+	// LatencyThreshold is the AIMD latency above which a request counts as failed, default 1s
+	LatencyThreshold Duration `json:"latencyThreshold"`
+	// Tolerance is the gradient latency increase over the no-load latency tolerated before lowering the limit, default 1.5
+	Tolerance float64 `json:"tolerance"`
+	// Smoothing is the gradient weight of a new limit, default 0.2
+	Smoothing float64 `json:"smoothing"`
+}
+
+// QueueConfig holds the settings of the queue requests wait in when all alive instances are busy
+type QueueConfig struct {
+	// MaxDepth is the number of requests allowed to wait, it must be positive
+	MaxDepth int `json:"maxDepth"`
+	// Timeout is how long a request waits before it's rejected with 503, it must be positive
+	Timeout Duration `json:"timeout"`
+}
+
+// InstanceConfig holds the settings of the instance with the URL
+type InstanceConfig struct {
+	URL string `json:"url"`
+	// MaxConnections overrides the pool's default when non-zero
+	MaxConnections int `json:"maxConnections"`
+	// Backup instances only take traffic when the pool failed over, see UpstreamConfig.FailoverThreshold
+	Backup bool `json:"backup"`
+	// Zone is the zone of the instance, see UpstreamConfig.Locality
+	Zone string `json:"zone"`
+	// Protocol overrides the pool's default when non-empty
+	Protocol string `json:"protocol"`
+}
+
+// CircuitBreakerConfig holds the settings of the per instance circuit breakers
+type CircuitBreakerConfig struct {
+	// ConsecutiveFailures trips the circuit after that many 5xx or failed requests in a row, 0 disables it
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// ErrorRate trips the circuit when the failure ratio in the rolling window reaches it, 0 disables it
+	ErrorRate float64 `json:"errorRate"`
+	// MinRequests is the number of requests the rolling window needs before ErrorRate applies
+	MinRequests int `json:"minRequests"`
+	// Window is the length of the rolling window, default 10s
+	Window Duration `json:"window"`
+	// OpenDuration is how long the circuit stays open before trial requests, default 5s
+	OpenDuration Duration `json:"openDuration"`
+	// HalfOpenRequests is the number of trial requests in the half-open state, default 1
+	HalfOpenRequests int `json:"halfOpenRequests"`
+}
+
+// TransportConfig holds the connection pooling and timeout settings of the upstream transport.
+// Unset fields keep the Go http.DefaultTransport defaults.
+type TransportConfig struct {
+	MaxIdleConns          int      `json:"maxIdleConns"`
+	MaxIdleConnsPerHost   int      `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost       int      `json:"maxConnsPerHost"`
+	IdleConnTimeout       Duration `json:"idleConnTimeout"`
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout"`
+	TLSHandshakeTimeout   Duration `json:"tlsHandshakeTimeout"`
+	DialTimeout           Duration `json:"dialTimeout"`
+	// KeepAlive is the TCP keep-alive period, negative disables TCP keep-alive probes
+	KeepAlive Duration `json:"keepAlive"`
+	// DisableKeepAlives disables HTTP keep-alive so every request uses a new connection
+	DisableKeepAlives bool `json:"disableKeepAlives"`
+}
+
+// Instance returns the settings of the instance with the url merged with the pool defaults
+func (c *UpstreamConfig) Instance(url string) InstanceConfig {
+	instance := InstanceConfig{URL: url, MaxConnections: c.MaxConnections, Protocol: c.Protocol}
+	for _, ic := range c.Instances {
+		if ic.URL != url {
+			continue
+		}
+		if ic.MaxConnections != 0 {
+			instance.MaxConnections = ic.MaxConnections
+		}
+		instance.Backup = ic.Backup
+		instance.Zone = ic.Zone
+		if ic.Protocol != "" {
+			instance.Protocol = ic.Protocol
+		}
+	}
+	return instance
+}
+
+// Duration is a time.Duration written as a string in the config file, e.g., "1.5s" or "300ms"
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return fmt.Errorf("duration should be a string, e.g., \"1s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// TLSConfig holds the TLS settings used to connect to the upstream instances
+type TLSConfig struct {
+	// CAFile is a PEM bundle used to verify the instances' certificates instead of the system roots
+	CAFile string `json:"caFile"`
+	// CertFile and KeyFile are the client certificate presented to the instances
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ServerName overrides the SNI and the name used to verify the instances' certificates
+	ServerName string `json:"serverName"`
+	// InsecureSkipVerify disables certificate verification, for staging only
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+// Load reads and parses the config file at path
+func Load(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ClientTLSConfig builds the tls.Config used to dial the upstream instances
+func (c *TLSConfig) ClientTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("both certFile and keyFile are required for the client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// MaxBodyBytes returns the request body limit of the path, a non-positive limit means unlimited
+func (c *Config) MaxBodyBytes(path string) int64 {
+	if route := c.Routes.Match(path); route != nil && route.MaxBodyBytes != 0 {
+		return route.MaxBodyBytes
+	}
+	return c.Listener.MaxBodyBytes
+}
+
+// DefaultReadHeaderTimeout bounds reading the request headers when the listener doesn't set it and on the admin API, e.g., against slowloris
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// HeaderTimeout returns the ReadHeaderTimeout of the http.Server, 10s if unset and zero for no timeout if negative
+func (c *ListenerConfig) HeaderTimeout() time.Duration {
+	switch {
+	case c.ReadHeaderTimeout == 0:
+		return DefaultReadHeaderTimeout
+	case c.ReadHeaderTimeout < 0:
+		return 0
+	}
+	return time.Duration(c.ReadHeaderTimeout)
+}
+
+// ConnTimeouts returns the read and write timeouts of the route of the path, zero if the listener's apply
+func (c *Config) ConnTimeouts(path string) (time.Duration, time.Duration) {
+	if route := c.Routes.Match(path); route != nil {
+		return time.Duration(route.ReadTimeout), time.Duration(route.WriteTimeout)
+	}
+	return 0, 0
+}
+
+// ServerTLSConfig builds the tls.Config of the listener.
+// Client certificates are verified against ClientCAFile when given, and whether one is required is decided per route.
+func (c *ListenerTLSConfig) ServerTLSConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("both certFile and keyFile are required for the listener")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool reads a PEM bundle into a cert pool
+func loadCertPool(path string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,307 @@
+package config
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		exp    *Config
+		expErr bool
+	}{
+		{
+			name: "upstream tls settings",
+			path: write("valid.json", `{"upstream":{"tls":{"caFile":"ca.pem","serverName":"backend.internal"}}}`),
+			exp: &Config{
+				Upstream: UpstreamConfig{
+					TLS: &TLSConfig{CAFile: "ca.pem", ServerName: "backend.internal"},
+				},
+			},
+		},
+		{
+			name: "named pool with its upstream settings",
+			path: write("pools.json", `{"pools":{"canary":{"urls":["http://canary:8081"],"maxConnections":10}}}`),
+			exp: &Config{
+				Pools: map[string]PoolConfig{
+					"canary": {URLs: []string{"http://canary:8081"}, UpstreamConfig: UpstreamConfig{MaxConnections: 10}},
+				},
+			},
+		},
+		{
+			name:   "malformed json",
+			path:   write("malformed.json", `{"upstream":`),
+			expErr: true,
+		},
+		{
+			name:   "missing file",
+			path:   filepath.Join(dir, "missing.json"),
+			expErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(tt.path)
+			if tt.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.exp, cfg)
+			}
+		})
+	}
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0o600))
+	emptyFile := filepath.Join(dir, "empty.pem")
+	assert.NoError(t, os.WriteFile(emptyFile, nil, 0o600))
+
+	t.Run("trusts the CA bundle", func(t *testing.T) {
+		tlsConfig, err := (&TLSConfig{CAFile: caFile}).ClientTLSConfig()
+		assert.NoError(t, err)
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(server.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	})
+
+	t.Run("CA bundle without certificates", func(t *testing.T) {
+		_, err := (&TLSConfig{CAFile: emptyFile}).ClientTLSConfig()
+		assert.Error(t, err)
+	})
+
+	t.Run("client certificate without key", func(t *testing.T) {
+		_, err := (&TLSConfig{CertFile: caFile}).ClientTLSConfig()
+		assert.EqualError(t, err, "both certFile and keyFile are required for the client certificate")
+	})
+}
+
+func TestRoutesMatch(t *testing.T) {
+	t.Parallel()
+
+	routes := Routes{
+		{PathPrefix: "/"},
+		{PathPrefix: "/internal", RequireClientCert: true},
+		{PathPrefix: "/internal/public"},
+	}
+
+	tests := []struct {
+		name   string
+		routes Routes
+		path   string
+		exp    *RouteConfig
+	}{
+		{
+			name:   "no routes",
+			routes: nil,
+			path:   "/echo",
+			exp:    nil,
+		},
+		{
+			name:   "fall back to root prefix",
+			routes: routes,
+			path:   "/echo",
+			exp:    &routes[0],
+		},
+		{
+			name:   "match longer prefix",
+			routes: routes,
+			path:   "/internal/echo",
+			exp:    &routes[1],
+		},
+		{
+			name:   "match longest prefix",
+			routes: routes,
+			path:   "/internal/public/echo",
+			exp:    &routes[2],
+		},
+		{
+			name:   "match the prefix exactly",
+			routes: routes,
+			path:   "/internal",
+			exp:    &routes[1],
+		},
+		{
+			name:   "prefix not ending at a segment boundary",
+			routes: routes,
+			path:   "/internals",
+			exp:    &routes[0],
+		},
+		{
+			name:   "longest prefix not ending at a segment boundary",
+			routes: routes,
+			path:   "/internal/publicity",
+			exp:    &routes[1],
+		},
+		{
+			name:   "prefix ending with a slash",
+			routes: Routes{{PathPrefix: "/v1/"}},
+			path:   "/v1/echo",
+			exp:    &Routes{{PathPrefix: "/v1/"}}[0],
+		},
+		{
+			name:   "no prefix at a segment boundary",
+			routes: Routes{{PathPrefix: "/admin"}},
+			path:   "/administrator",
+			exp:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.exp, tt.routes.Match(tt.path))
+		})
+	}
+}
+
+func TestConfigMaxBodyBytes(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{
+		Listener: ListenerConfig{MaxBodyBytes: 1024},
+		Routes: Routes{
+			{PathPrefix: "/upload", MaxBodyBytes: 1 << 30},
+			{PathPrefix: "/stream", MaxBodyBytes: -1},
+			{PathPrefix: "/internal", RequireClientCert: true},
+		},
+	}
+
+	tests := []struct {
+		name string
+		path string
+		exp  int64
+	}{
+		{name: "no matching route", path: "/echo", exp: 1024},
+		{name: "route override", path: "/upload/avatar", exp: 1 << 30},
+		{name: "route unlimited", path: "/stream", exp: -1},
+		{name: "route without override", path: "/internal/echo", exp: 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.exp, cfg.MaxBodyBytes(tt.path))
+		})
+	}
+}
+
+func TestConfigConnTimeouts(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{
+		Listener: ListenerConfig{ReadTimeout: Duration(30 * time.Second), WriteTimeout: Duration(30 * time.Second)},
+		Routes: Routes{
+			{PathPrefix: "/upload", ReadTimeout: Duration(10 * time.Minute), WriteTimeout: Duration(10 * time.Minute)},
+			{PathPrefix: "/stream", WriteTimeout: -1},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		expRead  time.Duration
+		expWrite time.Duration
+	}{
+		{name: "no matching route", path: "/echo"},
+		{name: "route overrides", path: "/upload/avatar", expRead: 10 * time.Minute, expWrite: 10 * time.Minute},
+		{name: "route without write timeout", path: "/stream", expWrite: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			read, write := cfg.ConnTimeouts(tt.path)
+			assert.Equal(t, tt.expRead, read)
+			assert.Equal(t, tt.expWrite, write)
+		})
+	}
+}
+
+func TestListenerConfigHeaderTimeout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		timeout Duration
+		exp     time.Duration
+	}{
+		{name: "default", exp: 10 * time.Second},
+		{name: "set", timeout: Duration(time.Second), exp: time.Second},
+		{name: "disabled", timeout: -1, exp: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := ListenerConfig{ReadHeaderTimeout: tt.timeout}
+			assert.Equal(t, tt.exp, l.HeaderTimeout())
+		})
+	}
+}
+
+func TestUpstreamConfigInstance(t *testing.T) {
+	t.Parallel()
+
+	upstream := UpstreamConfig{
+		MaxConnections: 10,
+		Protocol:       "h2c",
+		Instances: []InstanceConfig{
+			{URL: "http://localhost:8081", Protocol: "http/1.1", Zone: "a"},
+			{URL: "http://localhost:8082", MaxConnections: 20},
+		},
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		exp  InstanceConfig
+	}{
+		{
+			name: "instance protocol overrides the pool's",
+			url:  "http://localhost:8081",
+			exp:  InstanceConfig{URL: "http://localhost:8081", MaxConnections: 10, Protocol: "http/1.1", Zone: "a"},
+		},
+		{
+			name: "pool protocol by default",
+			url:  "http://localhost:8082",
+			exp:  InstanceConfig{URL: "http://localhost:8082", MaxConnections: 20, Protocol: "h2c"},
+		},
+		{
+			name: "instance not listed",
+			url:  "http://localhost:8083",
+			exp:  InstanceConfig{URL: "http://localhost:8083", MaxConnections: 10, Protocol: "h2c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.exp, upstream.Instance(tt.url))
+		})
+	}
+}
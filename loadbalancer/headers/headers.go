@@ -0,0 +1,114 @@
+package headers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// RequestIDHeader carries the request ID, it's generated by the Middleware if the client didn't send one
+const RequestIDHeader = "X-Request-ID"
+
+// Rules holds the header changes of a request or a response, applied in the order Remove, Set then Add.
+// Values may contain the templates {client_ip}, {backend} and {request_id}.
+type Rules struct {
+	// Add appends the values to the headers
+	Add map[string]string
+	// Set replaces the headers with the values
+	Set map[string]string
+	// Remove deletes the headers
+	Remove []string
+}
+
+// Policy holds the header changes of the requests going upstream and of the responses going back
+type Policy struct {
+	Request  Rules
+	Response Rules
+}
+
+// contextKey is the context key of the policy of a request
+type contextKey struct{}
+
+// requestPolicy is the policy of a request along with the template values known before the backend is chosen
+type requestPolicy struct {
+	policy    *Policy
+	clientIP  string
+	requestID string
+}
+
+// Middleware stores the policy of the request in its context for ApplyRequest and ApplyResponse,
+// and makes sure the requests with a policy have a request ID
+func Middleware(policy func(r *http.Request) *Policy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := policy(r)
+			if p == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			requestID := r.Header.Get(RequestIDHeader)
+			if requestID == "" {
+				requestID = newRequestID()
+				r.Header.Set(RequestIDHeader, requestID)
+			}
+			rp := &requestPolicy{policy: p, clientIP: clientIP(r), requestID: requestID}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, rp)))
+		})
+	}
+}
+
+// ApplyRequest applies the request rules of the policy in the context of the request going to the backend
+func ApplyRequest(r *http.Request, backend string) {
+	if rp, ok := r.Context().Value(contextKey{}).(*requestPolicy); ok {
+		rp.apply(r.Header, rp.policy.Request, backend)
+	}
+}
+
+// ApplyResponse applies the response rules of the policy in the context of the request of the response
+func ApplyResponse(resp *http.Response, backend string) {
+	if resp.Request == nil {
+		return
+	}
+	if rp, ok := resp.Request.Context().Value(contextKey{}).(*requestPolicy); ok {
+		rp.apply(resp.Header, rp.policy.Response, backend)
+	}
+}
+
+// apply changes the header by the rules with the templates expanded
+func (rp *requestPolicy) apply(header http.Header, rules Rules, backend string) {
+	expand := strings.NewReplacer(
+		"{client_ip}", rp.clientIP,
+		"{backend}", backend,
+		"{request_id}", rp.requestID,
+	)
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+	for name, value := range rules.Set {
+		header.Set(name, expand.Replace(value))
+	}
+	for name, value := range rules.Add {
+		header.Add(name, expand.Replace(value))
+	}
+}
+
+// newRequestID returns a random 128 bits ID in hex
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clientIP returns the IP of the client connection like middleware.ClientIP, the balancer can't depend on the middleware package
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,113 @@
+package headers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareApply(t *testing.T) {
+	t.Parallel()
+
+	var upstreamHeader http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.Header().Set("Server", "echo/1.0")
+		w.Header().Set("X-Powered-By", "go")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	proxy := httputil.NewSingleHostReverseProxy(backendURL)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		ApplyRequest(r, backendURL.Host)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		ApplyResponse(resp, backendURL.Host)
+		return nil
+	}
+
+	policy := &Policy{
+		Request: Rules{
+			Set:    map[string]string{"X-Internal-Token": "secret", "X-Real-IP": "{client_ip}"},
+			Add:    map[string]string{"Via": "lb {request_id}"},
+			Remove: []string{"Cookie"},
+		},
+		Response: Rules{
+			Set:    map[string]string{"Strict-Transport-Security": "max-age=31536000", "X-Backend": "{backend}"},
+			Remove: []string{"Server", "X-Powered-By"},
+		},
+	}
+	handler := Middleware(func(r *http.Request) *Policy {
+		if r.URL.Path == "/echo" {
+			return policy
+		}
+		return nil
+	})(proxy)
+
+	tests := []struct {
+		name         string
+		path         string
+		requestID    string
+		expApplied   bool
+		expRequestID string
+	}{
+		{
+			name:         "route with a policy keeps the client request ID",
+			path:         "/echo",
+			requestID:    "abc",
+			expApplied:   true,
+			expRequestID: "abc",
+		},
+		{
+			name:       "route with a policy generates a request ID",
+			path:       "/echo",
+			expApplied: true,
+		},
+		{
+			name: "route without a policy",
+			path: "/other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.Header.Set("Cookie", "session=1")
+			if tt.requestID != "" {
+				r.Header.Set(RequestIDHeader, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if !tt.expApplied {
+				assert.Equal(t, "session=1", upstreamHeader.Get("Cookie"))
+				assert.Empty(t, upstreamHeader.Get(RequestIDHeader))
+				assert.Equal(t, "echo/1.0", w.Header().Get("Server"))
+				return
+			}
+			requestID := upstreamHeader.Get(RequestIDHeader)
+			if tt.expRequestID != "" {
+				assert.Equal(t, tt.expRequestID, requestID)
+			} else {
+				assert.Len(t, requestID, 32)
+			}
+			assert.Equal(t, "secret", upstreamHeader.Get("X-Internal-Token"))
+			assert.Equal(t, "192.0.2.1", upstreamHeader.Get("X-Real-IP"))
+			assert.Equal(t, "lb "+requestID, upstreamHeader.Get("Via"))
+			assert.Empty(t, upstreamHeader.Get("Cookie"))
+
+			assert.Equal(t, "max-age=31536000", w.Header().Get("Strict-Transport-Security"))
+			assert.Equal(t, backendURL.Host, w.Header().Get("X-Backend"))
+			assert.Empty(t, w.Header().Get("Server"))
+			assert.Empty(t, w.Header().Get("X-Powered-By"))
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package jsonbody
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MaxBytes is the largest request body read for routing, larger bodies are not parsed
+const MaxBytes = 64 << 10
+
+// errTooLarge is returned by Read when the body is larger than MaxBytes
+var errTooLarge = errors.New("the request body is too large to be routed by")
+
+// Read parses the JSON request body and restores it, so the body is still sent upstream in full.
+// It fails if the body is not JSON or larger than MaxBytes.
+func Read(r *http.Request) (interface{}, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, errors.New("the request has no body")
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxBytes+1))
+	// the rest of the body, or the read error, is kept for the proxy
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxBytes {
+		return nil, errTooLarge
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Lookup returns the value at the path of the parsed JSON body, e.g., "game", "$.player.id" or "items.0.name".
+// Strings, numbers and booleans are returned as text, false is returned for objects, arrays, null or missing fields.
+func Lookup(doc interface{}, path string) (string, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path != "" {
+		for _, field := range strings.Split(path, ".") {
+			switch node := doc.(type) {
+			case map[string]interface{}:
+				value, ok := node[field]
+				if !ok {
+					return "", false
+				}
+				doc = value
+			case []interface{}:
+				i, err := strconv.Atoi(field)
+				if err != nil || i < 0 || i >= len(node) {
+					return "", false
+				}
+				doc = node[i]
+			default:
+				return "", false
+			}
+		}
+	}
+	switch value := doc.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// Field reads the JSON request body and returns the value at the path, see Read and Lookup
+func Field(r *http.Request, path string) (string, bool) {
+	doc, err := Read(r)
+	if err != nil {
+		return "", false
+	}
+	return Lookup(doc, path)
+}
@@ -0,0 +1,79 @@
+package jsonbody
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestField(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		body     string
+		path     string
+		exp      string
+		expFound bool
+	}{
+		{
+			name:     "top level string",
+			body:     `{"game":"Mobile Legends", "gamerID":"GYUTDTE", "points":20}`,
+			path:     "game",
+			exp:      "Mobile Legends",
+			expFound: true,
+		},
+		{
+			name:     "number with root prefix",
+			body:     `{"game":"Mobile Legends", "points":20}`,
+			path:     "$.points",
+			exp:      "20",
+			expFound: true,
+		},
+		{
+			name:     "nested field in array",
+			body:     `{"players":[{"id":"a"},{"id":"b","vip":true}]}`,
+			path:     "players.1.vip",
+			exp:      "true",
+			expFound: true,
+		},
+		{
+			name: "object value",
+			body: `{"player":{"id":"a"}}`,
+			path: "player",
+		},
+		{
+			name: "missing field",
+			body: `{"game":"Mobile Legends"}`,
+			path: "region",
+		},
+		{
+			name: "malformed body",
+			body: `{"game":`,
+			path: "game",
+		},
+		{
+			name: "oversized body",
+			body: `{"game":"Mobile Legends","padding":"` + strings.Repeat("a", MaxBytes) + `"}`,
+			path: "game",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(tt.body))
+			value, found := Field(r, tt.path)
+			assert.Equal(t, tt.expFound, found)
+			assert.Equal(t, tt.exp, value)
+
+			// the body is restored in full for the proxy
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
@@ -1,21 +1,45 @@
 package main
 
 import (
+	"app/loadbalancer/admin"
 	"app/loadbalancer/balancer"
+	"app/loadbalancer/canary"
+	"app/loadbalancer/config"
+	"app/loadbalancer/headers"
+	"app/loadbalancer/middleware"
+	"app/loadbalancer/mirror"
+	"app/loadbalancer/rewrite"
+	"app/loadbalancer/rules"
+	"app/loadbalancer/split"
+	"app/loadbalancer/tcpproxy"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Usage: go run loadbalancer/main.go -port 8080 -urls http://localhost:8081,http://localhost:8082,http://localhost:8083
 // Example CURL: curl -d '{"game":"Mobile Legends", "gamerID":"GYUTDTE", "points":20}' -H "Content-Type: application/json" -X POST http://localhost:8080/echo
 
+// shutdownTimeout bounds the wait for the requests in flight on shutdown
+const shutdownTimeout = 30 * time.Second
+
 // Balancer define the balancer interface
 type Balancer interface {
 	// ServeHTTP implements http.Handler
@@ -29,20 +53,42 @@ type Balancer interface {
 // LoadBalancerServer implements server start/close and http.Handler interface
 type LoadBalancerServer struct {
 	balancer Balancer
-	handler  http.Handler
+	// rules is nil if there is no routing rule
+	rules   *rules.Engine
+	handler http.Handler
 
 	stopHealthCheck func()
 }
 
-// NewLoadBalancerServer new a load balancer server
-func NewLoadBalancerServer(b Balancer) *LoadBalancerServer {
-	// route all POST requests to loadbalancer
-	r := mux.NewRouter()
-	r.PathPrefix("/").Methods("POST").Handler(b)
-	return &LoadBalancerServer{
+// NewLoadBalancerServer new a load balancer server, the middlewares are applied in order before the balancer.
+// The requests matching a rule of the engine are sent to its pool instead of the balancer, engine may be nil.
+// The requests matching redirect, if not nil, go through the middlewares whatever their method, so they get their redirect.
+func NewLoadBalancerServer(b Balancer, engine *rules.Engine, redirect mux.MatcherFunc, middlewares ...mux.MiddlewareFunc) *LoadBalancerServer {
+	h := &LoadBalancerServer{
 		balancer: b,
-		handler:  r,
+		rules:    engine,
+	}
+	// route all POST requests and the GET upgrade requests, e.g., WebSockets, to loadbalancer
+	r := mux.NewRouter()
+	if redirect != nil {
+		r.PathPrefix("/").MatcherFunc(redirect).HandlerFunc(h.delegate)
 	}
+	r.PathPrefix("/").Methods("POST").HandlerFunc(h.delegate)
+	r.PathPrefix("/").Methods("GET").MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return balancer.IsUpgrade(r)
+	}).HandlerFunc(h.delegate)
+	r.Use(middlewares...)
+	h.handler = r
+	return h
+}
+
+// delegate sends the request to the pool of the first matching rule, or to the balancer if none matches
+func (h *LoadBalancerServer) delegate(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := h.rules.Match(r); ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	h.balancer.ServeHTTP(w, r)
 }
 
 // ServeHTTP implements the http.Handler interface
@@ -82,36 +128,642 @@ func (h *LoadBalancerServer) RunHealthCheck(ctx context.Context, intervalInSecon
 	}()
 }
 
+// poolRouter sends the requests of the routes with a split or a mirror to their handler and the others to the default pool,
+// the health checks of all pools are run together
+type poolRouter struct {
+	defaultPool Balancer
+	pools       []Balancer
+	routes      config.Routes
+	// handlers is keyed by the path prefix of the routes
+	handlers map[string]http.Handler
+}
+
+// ServeHTTP implements http.Handler
+func (p *poolRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if route := p.routes.Match(r.URL.Path); route != nil {
+		if handler, ok := p.handlers[route.PathPrefix]; ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	p.defaultPool.ServeHTTP(w, r)
+}
+
+// HealthCheck run a round of health check on the instances of all pools
+func (p *poolRouter) HealthCheck() {
+	for _, pool := range p.pools {
+		pool.HealthCheck()
+	}
+}
+
+// GetHealthCheckInterval return the health check interval of the default pool
+func (p *poolRouter) GetHealthCheckInterval() int {
+	return p.defaultPool.GetHealthCheckInterval()
+}
+
+// newPools new the default pool of the urls and the named pools of the config file
+func newPools(cfg *config.Config, urls []string) (map[string]*balancer.RoundRobin, error) {
+	pools := map[string]*balancer.RoundRobin{}
+	newPool := func(name string, upstream config.UpstreamConfig, urls []string) error {
+		opts, err := upstreamOptions(upstream, urls)
+		if err != nil {
+			return err
+		}
+		// RoundRobin balancer support simple round robin algorithm
+		// WeightedRoundRobin balancer support weighted round robin based on the request response time
+		pools[name], err = balancer.NewRoundRobin(urls, 5, append(opts, balancer.WithName(name))...)
+		// pools[name], err = balancer.NewWeightedRoundRobin(urls, 5, append(opts, balancer.WithName(name))...)
+		return err
+	}
+
+	if err := newPool("default", cfg.Upstream, urls); err != nil {
+		return nil, err
+	}
+	for name, pool := range cfg.Pools {
+		if name == "default" {
+			return nil, errors.New("the pool name \"default\" is reserved for the pool of the -urls flag")
+		}
+		if err := newPool(name, pool.UpstreamConfig, pool.URLs); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+	}
+	return pools, nil
+}
+
+// newSplitters new the splitters of the routes with a split and the canary analyses of the splits, keyed by the split names
+func newSplitters(cfg *config.Config, pools map[string]*balancer.RoundRobin) (map[string]*split.Splitter, map[string]*canary.Analyzer, error) {
+	splitters := map[string]*split.Splitter{}
+	analyzers := map[string]*canary.Analyzer{}
+	for _, route := range cfg.Routes {
+		sc := route.Split
+		if sc == nil {
+			continue
+		}
+		if sc.Name == "" || splitters[sc.Name] != nil {
+			return nil, nil, fmt.Errorf("the split of route %s needs a unique name", route.PathPrefix)
+		}
+		variants := []split.Variant{}
+		for _, vc := range sc.Variants {
+			pool, ok := pools[vc.Pool]
+			if !ok {
+				return nil, nil, fmt.Errorf("unknown pool %s in split %s", vc.Pool, sc.Name)
+			}
+			variants = append(variants, split.Variant{Name: vc.Pool, Handler: pool, Weight: vc.Weight})
+		}
+		key := sc.Key
+		if key == "" {
+			key = "ip"
+		}
+		keyFunc, err := middleware.ParseKeyFunc(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts := split.Options{Header: sc.Header, Cookie: sc.Cookie, Key: keyFunc}
+		// the analyzer is set before the splitter serves any request
+		var analyzer *canary.Analyzer
+		if sc.Canary != nil {
+			opts.Observe = func(variant string, failed bool, latency time.Duration) {
+				analyzer.Observe(variant, failed, latency)
+			}
+		}
+		splitters[sc.Name], err = split.NewSplitter(sc.Name, variants, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cc := sc.Canary; cc != nil {
+			analyzer, err = canary.NewAnalyzer(sc.Name, splitters[sc.Name], canary.Policy{
+				Baseline:             cc.Baseline,
+				Canary:               cc.Canary,
+				Steps:                cc.Steps,
+				Interval:             time.Duration(cc.Interval),
+				MinRequests:          cc.MinRequests,
+				MaxErrorRateIncrease: cc.MaxErrorRateIncrease,
+				MaxLatencyRatio:      cc.MaxLatencyRatio,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			analyzers[sc.Name] = analyzer
+		}
+	}
+	return splitters, analyzers, nil
+}
+
+// upstreamOptions converts the upstream settings of the config file to the options of a balancer of the urls
+func upstreamOptions(upstream config.UpstreamConfig, urls []string) ([]balancer.Option, error) {
+	opts := []balancer.Option{}
+	for _, u := range urls {
+		instance := upstream.Instance(u)
+		opts = append(opts, balancer.WithInstanceOptions(u, balancer.InstanceOptions{
+			MaxConnections: instance.MaxConnections,
+			Backup:         instance.Backup,
+			Zone:           instance.Zone,
+			Protocol:       instance.Protocol,
+		}))
+	}
+	if upstream.FailoverThreshold != 0 {
+		opts = append(opts, balancer.WithFailoverThreshold(upstream.FailoverThreshold))
+	}
+	if l := upstream.Locality; l != nil {
+		opts = append(opts, balancer.WithLocality(balancer.LocalityOptions{
+			Zone:            l.Zone,
+			MinLocalPercent: l.MinLocalPercent,
+		}))
+	}
+	if upstream.UpgradeGracePeriod > 0 {
+		opts = append(opts, balancer.WithUpgradeGracePeriod(time.Duration(upstream.UpgradeGracePeriod)))
+	}
+	if q := upstream.Queue; q != nil {
+		if q.MaxDepth <= 0 || q.Timeout <= 0 {
+			return nil, errors.New("upstream.queue needs a positive maxDepth and timeout")
+		}
+		opts = append(opts, balancer.WithQueue(balancer.QueueOptions{
+			MaxDepth: q.MaxDepth,
+			Timeout:  time.Duration(q.Timeout),
+		}))
+	}
+	if upstream.TLS != nil {
+		tlsConfig, err := upstream.TLS.ClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, balancer.WithTLSConfig(tlsConfig))
+	}
+	if cb := upstream.CircuitBreaker; cb != nil {
+		opts = append(opts, balancer.WithCircuitBreaker(balancer.CircuitBreakerOptions{
+			ConsecutiveFailures: cb.ConsecutiveFailures,
+			ErrorRate:           cb.ErrorRate,
+			MinRequests:         cb.MinRequests,
+			Window:              time.Duration(cb.Window),
+			OpenDuration:        time.Duration(cb.OpenDuration),
+			HalfOpenRequests:    cb.HalfOpenRequests,
+		}))
+	}
+	if al := upstream.AdaptiveLimit; al != nil {
+		opts = append(opts, balancer.WithAdaptiveLimit(balancer.AdaptiveLimitOptions{
+			Algorithm:        al.Algorithm,
+			InitialLimit:     al.InitialLimit,
+			MinLimit:         al.MinLimit,
+			MaxLimit:         al.MaxLimit,
+			BackoffRatio:     al.BackoffRatio,
+			LatencyThreshold: time.Duration(al.LatencyThreshold),
+			Tolerance:        al.Tolerance,
+			Smoothing:        al.Smoothing,
+		}))
+	}
+	if ss := upstream.SlowStart; ss != nil {
+		opts = append(opts, balancer.WithSlowStart(balancer.SlowStartOptions{
+			Window:           time.Duration(ss.Window),
+			MinWeightPercent: ss.MinWeightPercent,
+			Aggression:       ss.Aggression,
+		}))
+	}
+	if hc := upstream.HealthCheck; hc != nil {
+		opts = append(opts, balancer.WithHealthCheck(balancer.HealthCheckOptions{
+			Type:    hc.Type,
+			Path:    hc.Path,
+			Service: hc.Service,
+			Timeout: time.Duration(hc.Timeout),
+		}))
+	}
+	if t := upstream.Transport; t != nil {
+		opts = append(opts, balancer.WithTransportOptions(balancer.TransportOptions{
+			MaxIdleConns:          t.MaxIdleConns,
+			MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       t.MaxConnsPerHost,
+			IdleConnTimeout:       time.Duration(t.IdleConnTimeout),
+			ResponseHeaderTimeout: time.Duration(t.ResponseHeaderTimeout),
+			TLSHandshakeTimeout:   time.Duration(t.TLSHandshakeTimeout),
+			DialTimeout:           time.Duration(t.DialTimeout),
+			KeepAlive:             time.Duration(t.KeepAlive),
+			DisableKeepAlives:     t.DisableKeepAlives,
+		}))
+	}
+	return opts, nil
+}
+
+// headerPolicies converts the header changes of the routes to a function returning the policy of a request
+func headerPolicies(cfg *config.Config) func(r *http.Request) *headers.Policy {
+	toRules := func(rc config.HeaderRulesConfig) headers.Rules {
+		return headers.Rules{Add: rc.Add, Set: rc.Set, Remove: rc.Remove}
+	}
+	routePolicies := map[string]*headers.Policy{}
+	for _, route := range cfg.Routes {
+		if hc := route.Headers; hc != nil {
+			routePolicies[route.PathPrefix] = &headers.Policy{Request: toRules(hc.Request), Response: toRules(hc.Response)}
+		}
+	}
+	return func(r *http.Request) *headers.Policy {
+		if route := cfg.Routes.Match(r.URL.Path); route != nil {
+			return routePolicies[route.PathPrefix]
+		}
+		return nil
+	}
+}
+
+// rewritePolicies converts the URL rewrites of the routes to a function returning the policy of a request
+func rewritePolicies(cfg *config.Config) (func(r *http.Request) *rewrite.Policy, error) {
+	routePolicies := map[string]*rewrite.Policy{}
+	for _, route := range cfg.Routes {
+		rc := route.Rewrite
+		if rc == nil {
+			continue
+		}
+		policy, err := rewrite.NewPolicy(rewrite.Options{
+			PathRegex:       rc.PathRegex,
+			PathReplacement: rc.PathReplacement,
+			StripPrefix:     rc.StripPrefix,
+			AddPrefix:       rc.AddPrefix,
+			Host:            rc.Host,
+			RedirectStatus:  rc.RedirectStatus,
+			RedirectScheme:  rc.RedirectScheme,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("rewrite of route %s: %w", route.PathPrefix, err)
+		}
+		routePolicies[route.PathPrefix] = policy
+	}
+	return func(r *http.Request) *rewrite.Policy {
+		if route := cfg.Routes.Match(r.URL.Path); route != nil {
+			return routePolicies[route.PathPrefix]
+		}
+		return nil
+	}, nil
+}
+
+// rateLimitPolicies converts the rate limits of the config file to a function returning the policy of a request
+func rateLimitPolicies(cfg *config.Config) (func(r *http.Request) *middleware.RateLimitPolicy, error) {
+	newPolicy := func(name string, rl *config.RateLimitConfig) (*middleware.RateLimitPolicy, error) {
+		if rl == nil {
+			return nil, nil
+		}
+		keyOpts := middleware.KeyOptions{}
+		if cfg.Listener.TLS != nil && cfg.Listener.TLS.ClientIdentityHeader != "" {
+			keyOpts.TrustedHeaders = []string{cfg.Listener.TLS.ClientIdentityHeader}
+		}
+		if rl.JWTSecretFile != "" {
+			secret, err := os.ReadFile(rl.JWTSecretFile)
+			if err != nil {
+				return nil, err
+			}
+			keyOpts.JWTSecret = bytes.TrimSpace(secret)
+		}
+		key, err := middleware.ParseVerifiedKeyFunc(rl.Key, keyOpts)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit of %q: %w", name, err)
+		}
+		return &middleware.RateLimitPolicy{Name: name, Key: key, Burst: rl.Burst, Rate: rl.RatePerSecond}, nil
+	}
+
+	defaultPolicy, err := newPolicy("", cfg.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	routePolicies := map[string]*middleware.RateLimitPolicy{}
+	for _, route := range cfg.Routes {
+		if routePolicies[route.PathPrefix], err = newPolicy(route.PathPrefix, route.RateLimit); err != nil {
+			return nil, err
+		}
+	}
+	return func(r *http.Request) *middleware.RateLimitPolicy {
+		if route := cfg.Routes.Match(r.URL.Path); route != nil && routePolicies[route.PathPrefix] != nil {
+			return routePolicies[route.PathPrefix]
+		}
+		return defaultPolicy
+	}, nil
+}
+
+// shutdown runs the graceful shutdown of the listener and, in parallel, the shutdown of every pool,
+// closing their upgraded connections after the grace period
+func shutdown(pools map[string]*balancer.RoundRobin, shutdownListener func(ctx context.Context) error) {
+	var wg sync.WaitGroup
+	for _, pool := range pools {
+		wg.Add(1)
+		go func(pool *balancer.RoundRobin) {
+			defer wg.Done()
+			pool.Shutdown()
+		}(pool)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdownListener(ctx); err != nil {
+		log.Printf("failed to shut down gracefully with error: %s\n", err.Error())
+	}
+	wg.Wait()
+}
+
+// serveTCP pipes the TCP connections of the port to the instances of the default pool until SIGINT or SIGTERM,
+// the connections in flight are then given the shutdown timeout to end
+func serveTCP(port int, cfg *config.Config, pools map[string]*balancer.RoundRobin) {
+	if cfg.Listener.TLS != nil {
+		log.Fatal("the listener tls is not supported in tcp mode")
+	}
+	opts := tcpproxy.Options{IdleTimeout: time.Duration(cfg.Listener.IdleTimeout)}
+	if t := cfg.Upstream.Transport; t != nil {
+		opts.DialTimeout = time.Duration(t.DialTimeout)
+	}
+	proxy := tcpproxy.NewProxy("default", pools["default"], opts)
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Printf("shutting down\n")
+		shutdown(pools, proxy.Shutdown)
+		close(shutdownDone)
+	}()
+
+	log.Printf("listen on: %s (tcp)\n", listener.Addr())
+	if err := proxy.Serve(listener); !errors.Is(err, tcpproxy.ErrProxyClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+}
+
+// queueWaitOf returns how long the oldest request has waited in the queue of the pool a request goes to,
+// the longest wait of the pools of the split of its route as the variant is picked later
+func queueWaitOf(cfg *config.Config, engine *rules.Engine, pools map[string]*balancer.RoundRobin) func(r *http.Request) time.Duration {
+	return func(r *http.Request) time.Duration {
+		if handler, ok := engine.Match(r); ok {
+			if pool, ok := handler.(*balancer.RoundRobin); ok {
+				return pool.QueueWait()
+			}
+		}
+		route := cfg.Routes.Match(r.URL.Path)
+		if route == nil || route.Split == nil {
+			return pools["default"].QueueWait()
+		}
+		var wait time.Duration
+		for _, vc := range route.Split.Variants {
+			if pool, ok := pools[vc.Pool]; ok && pool.QueueWait() > wait {
+				wait = pool.QueueWait()
+			}
+		}
+		return wait
+	}
+}
+
+// adminOptions reads the admin token, which is required unless the admin API only listens on the loopback interface
+func adminOptions(host, tokenFile string) ([]admin.Option, error) {
+	if tokenFile == "" {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("the admin API listening on %q needs -admin-token-file", host)
+		}
+		return nil, nil
+	}
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the admin token: %w", err)
+	}
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 {
+		return nil, fmt.Errorf("the admin token file %q is empty", tokenFile)
+	}
+	return []admin.Option{admin.WithToken(string(token))}, nil
+}
+
 func main() {
 	var port int
 	var urls string
+	var configPath string
+	var adminPort int
+	var adminHost string
+	var adminTokenFile string
 	flag.IntVar(&port, "port", 8080, "port to listen")
 	flag.StringVar(&urls, "urls", "", "target urls seperate by comma, e.g., \"http://0.0.0.0:8081,http://0.0.0.0:8082\"")
+	flag.StringVar(&configPath, "config", "", "optional JSON config file, e.g., \"lb.json\"")
+	flag.IntVar(&adminPort, "admin-port", 0, "port to serve the admin API and the metrics at /debug/vars, disabled if 0")
+	flag.StringVar(&adminHost, "admin-host", "127.0.0.1", "host the admin API listens on, e.g., \"0.0.0.0\" for every interface which needs -admin-token-file")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "optional file holding the bearer token required to drain instances and change split weights")
 	flag.Parse()
 
 	if urls == "" {
 		log.Fatal("Input urls is empty. See \"go run main.go -h\" for more info.")
 	}
 
-	// new a balancer to use
-	// RoundRobin balancer support simple round robin algorithm
-	// WeightedRoundRobin balancer support weighted round robin based on the request response time
-	balancer, err := balancer.NewRoundRobin(strings.Split(urls, ","), 5)
-	// balancer, err := balancer.NewWeightedRoundRobin(strings.Split(urls, ","), 5)
+	cfg := &config.Config{}
+	if configPath != "" {
+		var err error
+		cfg, err = config.Load(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// new the balancers of the pools with the upstream settings of the config file, and the traffic splits between them
+	pools, err := newPools(cfg, strings.Split(urls, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	splitters, analyzers, err := newSplitters(cfg, pools)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, analyzer := range analyzers {
+		go analyzer.Run(context.Background())
+	}
+	router := &poolRouter{
+		defaultPool: pools["default"],
+		routes:      cfg.Routes,
+		handlers:    map[string]http.Handler{},
+	}
+	for _, pool := range pools {
+		router.pools = append(router.pools, pool)
+	}
+	for _, route := range cfg.Routes {
+		var handler http.Handler = pools["default"]
+		if route.Split != nil {
+			handler = splitters[route.Split.Name]
+		}
+		if mc := route.Mirror; mc != nil {
+			shadow, ok := pools[mc.Pool]
+			if !ok {
+				log.Fatalf("unknown pool %s in the mirror of route %s", mc.Pool, route.PathPrefix)
+			}
+			handler = mirror.NewMirror(route.PathPrefix, shadow, mirror.Options{
+				Percent:      mc.Percent,
+				MaxBodyBytes: mc.MaxBodyBytes,
+				Timeout:      time.Duration(mc.Timeout),
+				MaxInFlight:  mc.MaxInFlight,
+			}).Middleware(handler)
+		}
+		router.handlers[route.PathPrefix] = handler
+	}
+
+	// build the routing rules consulted before the routes
+	var engine *rules.Engine
+	if len(cfg.Rules) > 0 {
+		rulePools := map[string]http.Handler{}
+		for name, pool := range pools {
+			rulePools[name] = pool
+		}
+		ruleList := []rules.Rule{}
+		for _, rc := range cfg.Rules {
+			ruleList = append(ruleList, rules.Rule{Headers: rc.Headers, Query: rc.Query, PathRegex: rc.PathRegex, Body: rc.Body, Pool: rc.Pool})
+		}
+		if engine, err = rules.NewEngine(ruleList, rulePools); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// build the middlewares applied before the balancer
+	var listenerTLS *tls.Config
+	identityHeader := ""
+	if cfg.Listener.TLS != nil {
+		listenerTLS, err = cfg.Listener.TLS.ServerTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		identityHeader = cfg.Listener.TLS.ClientIdentityHeader
+	}
+	rateLimitPolicy, err := rateLimitPolicies(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rewritePolicy, err := rewritePolicies(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	middlewares := []mux.MiddlewareFunc{
+		// first, so the error responses of all the others reach gRPC clients as gRPC status codes
+		middleware.GRPCStatus,
+		// routes requiring client certificates are rejected when the listener is not TLS
+		middleware.ClientAuth(identityHeader, func(r *http.Request) bool {
+			route := cfg.Routes.Match(r.URL.Path)
+			return route != nil && route.RequireClientCert
+		}),
+		// after ClientAuth, so the keys on the client identity header are the verified ones
+		middleware.NewRateLimiter().Middleware(rateLimitPolicy),
+		// before reading the body, so the route timeouts replace the listener's for uploads
+		middleware.ConnTimeouts(func(r *http.Request) (time.Duration, time.Duration) {
+			return cfg.ConnTimeouts(r.URL.Path)
+		}),
+		middleware.BodyLimit(func(r *http.Request) int64 {
+			return cfg.MaxBodyBytes(r.URL.Path)
+		}),
+		middleware.Deadline(func(r *http.Request) time.Duration {
+			if route := cfg.Routes.Match(r.URL.Path); route != nil {
+				return time.Duration(route.UpstreamTimeout)
+			}
+			return 0
+		}),
+		headers.Middleware(headerPolicies(cfg)),
+		// redirects end here, rewrites are applied to the upstream request by the balancer
+		rewrite.Middleware(rewritePolicy),
+	}
+	if ls := cfg.LoadShedding; ls != nil {
+		classes := []middleware.PriorityClass{}
+		for _, c := range ls.Classes {
+			classes = append(classes, middleware.PriorityClass{
+				Name:         c.Name,
+				MaxInFlight:  c.MaxInFlight,
+				MaxQueueWait: time.Duration(c.MaxQueueWait),
+			})
+		}
+		routeClass := func(r *http.Request) string {
+			if route := cfg.Routes.Match(r.URL.Path); route != nil {
+				return route.Priority
+			}
+			return ""
+		}
+		// the header is honored only from clients authenticated with a certificate
+		trustHeader := func(r *http.Request) bool {
+			return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+		}
+		shedder, err := middleware.NewLoadShedder(classes, ls.DefaultClass, ls.Header, trustHeader, routeClass, queueWaitOf(cfg, engine, pools))
+		if err != nil {
+			log.Fatal(err)
+		}
+		middlewares = append(middlewares, shedder.Middleware)
+	}
 
 	// new a load balancer server and start its health check
-	lbSrv := NewLoadBalancerServer(balancer)
+	lbSrv := NewLoadBalancerServer(router, engine, rewrite.Redirects(rewritePolicy), middlewares...)
 	lbSrv.Start()
 	defer lbSrv.Close()
 
+	// start admin server serving the metrics and the admin API
+	if adminPort != 0 {
+		adminOpts, err := adminOptions(adminHost, adminTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		adminPools := map[string]admin.Pool{}
+		for name, pool := range pools {
+			adminPools[name] = pool
+		}
+		adminSplits := map[string]admin.Split{}
+		for name, splitter := range splitters {
+			adminSplits[name] = splitter
+		}
+		adminCanaries := map[string]admin.Canary{}
+		for name, analyzer := range analyzers {
+			adminCanaries[name] = analyzer
+		}
+		adminSrv := &http.Server{
+			Addr:              net.JoinHostPort(adminHost, strconv.Itoa(adminPort)),
+			Handler:           admin.NewServer(adminPools, adminSplits, adminCanaries, adminOpts...),
+			ReadHeaderTimeout: config.DefaultReadHeaderTimeout,
+		}
+		log.Printf("admin listen on: %s\n", adminSrv.Addr)
+		go adminSrv.ListenAndServe()
+	}
+
+	switch cfg.Listener.Mode {
+	case "", config.ListenerModeHTTP:
+	case config.ListenerModeTCP:
+		serveTCP(port, cfg, pools)
+		return
+	default:
+		log.Fatalf("unknown listener mode %q, should be http or tcp", cfg.Listener.Mode)
+	}
+
 	// start http server
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: lbSrv,
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           lbSrv,
+		TLSConfig:         listenerTLS,
+		ReadTimeout:       time.Duration(cfg.Listener.ReadTimeout),
+		ReadHeaderTimeout: cfg.Listener.HeaderTimeout(),
+		WriteTimeout:      time.Duration(cfg.Listener.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.Listener.IdleTimeout),
+	}
+	// HTTP/2 is negotiated with ALPN on the TLS listener, cleartext HTTP/2 is opt-in
+	h2Server := &http2.Server{MaxConcurrentStreams: cfg.Listener.MaxConcurrentStreams}
+	if listenerTLS != nil {
+		if err := http2.ConfigureServer(srv, h2Server); err != nil {
+			log.Fatal(err)
+		}
+	} else if cfg.Listener.H2C {
+		srv.Handler = h2c.NewHandler(lbSrv, h2Server)
 	}
+
+	// on SIGINT or SIGTERM stop accepting connections and let the requests in flight finish,
+	// the upgraded connections of every pool are closed after their grace period
+	shutdownDone := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Printf("shutting down\n")
+		shutdown(pools, srv.Shutdown)
+		close(shutdownDone)
+	}()
+
 	log.Printf("listen on: %s\n", srv.Addr)
-	srv.ListenAndServe()
+	if listenerTLS != nil {
+		// the certificate is already loaded into srv.TLSConfig
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// BodyLimit returns a middleware limiting the request body to limit(r) bytes, a non-positive limit means unlimited.
+// Requests declaring a larger Content-Length are rejected with 413 right away, otherwise the body is wrapped
+// with http.MaxBytesReader and the balancer responds 413 once the proxy reads past the limit.
+func BodyLimit(limit func(r *http.Request) int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := limit(r)
+			if n <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > n {
+				log.Printf("reject request body of %d bytes larger than %d bytes: %s\n", r.ContentLength, n, r.URL.Path)
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"app/loadbalancer/balancer"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyLimit(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+	rr, err := balancer.NewRoundRobin([]string{backend.URL}, 5)
+	assert.NoError(t, err)
+
+	limit := func(r *http.Request) int64 {
+		if strings.HasPrefix(r.URL.Path, "/upload") {
+			return 0
+		}
+		return 10
+	}
+	handler := BodyLimit(limit)(rr)
+
+	tests := []struct {
+		name          string
+		path          string
+		body          string
+		contentLength int64
+		expCode       int
+	}{
+		{
+			name:          "body within the limit",
+			path:          "/echo",
+			body:          "0123456789",
+			contentLength: 10,
+			expCode:       http.StatusOK,
+		},
+		{
+			name:          "declared content length over the limit",
+			path:          "/echo",
+			body:          "0123456789a",
+			contentLength: 11,
+			expCode:       http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "chunked body over the limit",
+			path:          "/echo",
+			body:          strings.Repeat("a", 100000),
+			contentLength: -1,
+			expCode:       http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "unlimited route override",
+			path:          "/upload",
+			body:          strings.Repeat("a", 100000),
+			contentLength: -1,
+			expCode:       http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.expCode, w.Code)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ClientAuth returns a middleware enforcing client certificates on the requests `required` returns true for,
+// and forwarding the verified client identity to the instances in identityHeader.
+// The identity header sent by the client is always removed so it can't be spoofed.
+func ClientAuth(identityHeader string, required func(r *http.Request) bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if identityHeader != "" {
+				r.Header.Del(identityHeader)
+			}
+			cert := verifiedClientCert(r)
+			if cert == nil && required(r) {
+				log.Printf("reject request without verified client certificate: %s\n", r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if cert != nil && identityHeader != "" {
+				r.Header.Set(identityHeader, ClientIdentity(cert))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIdentity formats the SAN URIs and the subject CN of a client certificate, e.g., "URI=spiffe://game/api;CN=api"
+func ClientIdentity(cert *x509.Certificate) string {
+	parts := []string{}
+	for _, u := range cert.URIs {
+		parts = append(parts, "URI="+u.String())
+	}
+	if cert.Subject.CommonName != "" {
+		parts = append(parts, "CN="+cert.Subject.CommonName)
+	}
+	return strings.Join(parts, ";")
+}
+
+// verifiedClientCert returns the leaf of the verified client certificate chain, or nil if there is none
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
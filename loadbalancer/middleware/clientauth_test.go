@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientAuth(t *testing.T) {
+	t.Parallel()
+
+	spiffeURL, _ := url.Parse("spiffe://game/api")
+	clientCert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "api"},
+		URIs:    []*url.URL{spiffeURL},
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{clientCert}}}
+	internalOnly := func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, "/internal") }
+
+	tests := []struct {
+		name        string
+		path        string
+		tls         *tls.ConnectionState
+		spoofed     string
+		expCode     int
+		expIdentity string
+	}{
+		{
+			name:        "public path without client certificate",
+			path:        "/echo",
+			expCode:     http.StatusOK,
+			expIdentity: "",
+		},
+		{
+			name:        "public path removes spoofed identity",
+			path:        "/echo",
+			tls:         &tls.ConnectionState{},
+			spoofed:     "CN=admin",
+			expCode:     http.StatusOK,
+			expIdentity: "",
+		},
+		{
+			name:    "required path without client certificate",
+			path:    "/internal/echo",
+			tls:     &tls.ConnectionState{},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "required path on plain http listener",
+			path:    "/internal/echo",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:        "required path with verified client certificate",
+			path:        "/internal/echo",
+			tls:         verified,
+			spoofed:     "CN=admin",
+			expCode:     http.StatusOK,
+			expIdentity: "URI=spiffe://game/api;CN=api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity := ""
+			handler := ClientAuth("X-Client-Identity", internalOnly)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity = r.Header.Get("X-Client-Identity")
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			r.TLS = tt.tls
+			if tt.spoofed != "" {
+				r.Header.Set("X-Client-Identity", tt.spoofed)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expCode, w.Code)
+			assert.Equal(t, tt.expIdentity, identity)
+		})
+	}
+}
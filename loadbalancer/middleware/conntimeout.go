@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ConnTimeouts returns a middleware replacing the read and write deadlines of the connection set by the listener's
+// timeouts with timeouts(r) from now, e.g., longer ones for uploads. Zero keeps the listener's, negative means none.
+func ConnTimeouts(timeouts func(r *http.Request) (read, write time.Duration)) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			read, write := timeouts(r)
+			rc := http.NewResponseController(w)
+			if read != 0 {
+				if err := rc.SetReadDeadline(deadline(read)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					log.Printf("failed to set the read deadline with error: %s\n", err.Error())
+				}
+			}
+			if write != 0 {
+				if err := rc.SetWriteDeadline(deadline(write)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					log.Printf("failed to set the write deadline with error: %s\n", err.Error())
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// deadline returns the deadline of a timeout from now, the zero time for no deadline if the timeout is negative
+func deadline(timeout time.Duration) time.Time {
+	if timeout < 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnTimeouts(t *testing.T) {
+	t.Parallel()
+
+	timeouts := func(r *http.Request) (time.Duration, time.Duration) {
+		if strings.HasPrefix(r.URL.Path, "/upload") {
+			return time.Second, time.Second
+		}
+		return 0, 0
+	}
+	srv := httptest.NewUnstartedServer(ConnTimeouts(timeouts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})))
+	srv.Config.ReadTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		expCode int
+	}{
+		{name: "route override", path: "/upload", expCode: http.StatusOK},
+		{name: "listener timeout", path: "/echo", expCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			assert.NoError(t, err)
+			defer conn.Close()
+			// the body is sent after the listener's read timeout
+			_, err = io.WriteString(conn, "POST "+tt.path+" HTTP/1.1\r\nHost: lb\r\nContent-Length: 2\r\n\r\n")
+			assert.NoError(t, err)
+			time.Sleep(400 * time.Millisecond)
+			io.WriteString(conn, "hi")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expCode, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"app/loadbalancer/balancer"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deadline returns a middleware bounding the upstream request with timeout(r), a non-positive timeout means none.
+// A lower positive budget sent by the client in the balancer.TimeoutHeader is honored, the route budget stays the upper bound. The balancer cancels the
+// upstream request and responds 504 once the deadline passes, and propagates the remaining budget to the instances.
+// Only the route deadlines count as failures of the instances, so clients can't trip the circuits with short budgets.
+// Upgrade requests have no deadline, since the upgraded connection lives as long as the request.
+func Deadline(timeout func(r *http.Request) time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if balancer.IsUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			budget := timeout(r)
+			ctx := r.Context()
+			if header := r.Header.Get(balancer.TimeoutHeader); header != "" {
+				if clientBudget, err := balancer.ParseTimeout(header); err == nil && clientBudget > 0 && (budget <= 0 || clientBudget < budget) {
+					budget = clientBudget
+					ctx = balancer.WithClientDeadline(ctx)
+				}
+			}
+			if budget <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(ctx, budget)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
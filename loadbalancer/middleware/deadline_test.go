@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"app/loadbalancer/balancer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadline(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(balancer.TimeoutHeader)
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}))
+	defer backend.Close()
+	rr, err := balancer.NewRoundRobin([]string{backend.URL}, 5)
+	assert.NoError(t, err)
+
+	handler := Deadline(func(r *http.Request) time.Duration { return 200 * time.Millisecond })(rr)
+
+	tests := []struct {
+		name          string
+		path          string
+		clientTimeout string
+		expCode       int
+		expMaxBudget  time.Duration
+	}{
+		{
+			name:         "propagate the route budget",
+			path:         "/echo",
+			expCode:      http.StatusOK,
+			expMaxBudget: 200 * time.Millisecond,
+		},
+		{
+			name:          "honor the lower client budget",
+			path:          "/echo",
+			clientTimeout: "50m",
+			expCode:       http.StatusOK,
+			expMaxBudget:  50 * time.Millisecond,
+		},
+		{
+			name:          "ignore the higher client budget",
+			path:          "/echo",
+			clientTimeout: "10S",
+			expCode:       http.StatusOK,
+			expMaxBudget:  200 * time.Millisecond,
+		},
+		{
+			name:          "ignore the zero client budget",
+			path:          "/echo",
+			clientTimeout: "0n",
+			expCode:       http.StatusOK,
+			expMaxBudget:  200 * time.Millisecond,
+		},
+		{
+			name:          "ignore the overflowing client budget",
+			path:          "/echo",
+			clientTimeout: "99999999H",
+			expCode:       http.StatusOK,
+			expMaxBudget:  200 * time.Millisecond,
+		},
+		{
+			name:         "timeout on slow upstream",
+			path:         "/slow",
+			expCode:      http.StatusGatewayTimeout,
+			expMaxBudget: 200 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.clientTimeout != "" {
+				r.Header.Set(balancer.TimeoutHeader, tt.clientTimeout)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.expCode, w.Code)
+
+			budget, err := balancer.ParseTimeout(<-received)
+			assert.NoError(t, err)
+			assert.LessOrEqual(t, budget, tt.expMaxBudget)
+			assert.Greater(t, budget, time.Duration(0))
+		})
+	}
+}
+
+func TestDeadlineUpgrade(t *testing.T) {
+	t.Parallel()
+
+	hasDeadline := true
+	handler := Deadline(func(r *http.Request) time.Duration { return time.Second })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline = r.Context().Deadline()
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.False(t, hasDeadline)
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// GRPCStatus implements mux.MiddlewareFunc. The error responses to gRPC requests, e.g., 503 when no instance
+// is available or 502 when the upstream request failed, are turned into a 200 response with the gRPC status
+// in the trailers, so gRPC clients see the failure as a status code instead of a malformed response.
+// Responses carrying their own gRPC status are left as is.
+func GRPCStatus(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&grpcStatusWriter{ResponseWriter: w}, r)
+	})
+}
+
+// grpcCode maps the HTTP status of an error response to a gRPC status code,
+// following the gRPC HTTP to gRPC status code mapping except for the load balancer's own 413 and 504
+func grpcCode(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusRequestEntityTooLarge:
+		return codes.ResourceExhausted
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Unknown
+	}
+}
+
+// grpcStatusWriter rewrites the error responses to gRPC requests, see GRPCStatus
+type grpcStatusWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	// failed is set once an error response was rewritten, its body is dropped
+	failed bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *grpcStatusWriter) WriteHeader(status int) {
+	if w.wroteHeader || status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	if status == http.StatusOK || header.Get("Grpc-Status") != "" {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.failed = true
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/grpc")
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	// the trailers are set once the headers are written, see http.TrailerPrefix
+	header.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(grpcCode(status))))
+	header.Set(http.TrailerPrefix+"Grpc-Message", http.StatusText(status))
+}
+
+// Write implements http.ResponseWriter
+func (w *grpcStatusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the Flusher of the underlying writer
+func (w *grpcStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
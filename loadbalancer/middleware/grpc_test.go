@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"app/loadbalancer/balancer"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		expCode     int
+		expTrailer  string
+	}{
+		{
+			name:        "no instance available",
+			contentType: "application/grpc",
+			status:      http.StatusServiceUnavailable,
+			expCode:     http.StatusOK,
+			expTrailer:  "14",
+		},
+		{
+			name:        "deadline exceeded",
+			contentType: "application/grpc+proto",
+			status:      http.StatusGatewayTimeout,
+			expCode:     http.StatusOK,
+			expTrailer:  "4",
+		},
+		{
+			name:        "request body too large",
+			contentType: "application/grpc",
+			status:      http.StatusRequestEntityTooLarge,
+			expCode:     http.StatusOK,
+			expTrailer:  "8",
+		},
+		{
+			name:        "successful response",
+			contentType: "application/grpc",
+			status:      http.StatusOK,
+			expCode:     http.StatusOK,
+		},
+		{
+			name:        "not a gRPC request",
+			contentType: "application/json",
+			status:      http.StatusServiceUnavailable,
+			expCode:     http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := GRPCStatus(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte("not a gRPC message"))
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/echo.Echo/Say", nil)
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			resp := w.Result()
+			assert.Equal(t, tt.expCode, resp.StatusCode)
+			assert.Equal(t, tt.expTrailer, resp.Trailer.Get("Grpc-Status"))
+			if tt.expTrailer != "" {
+				assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+				assert.Empty(t, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestGRPCStatusProxy(t *testing.T) {
+	t.Parallel()
+
+	// an in-process gRPC server behind the load balancer
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closedListener.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		draining   bool
+		service    string
+		expCode    codes.Code
+		expMessage string
+	}{
+		{
+			name:    "proxied with the trailers",
+			url:     "http://" + listener.Addr().String(),
+			service: "echo",
+			expCode: codes.OK,
+		},
+		{
+			name:       "status of the instance",
+			url:        "http://" + listener.Addr().String(),
+			service:    "lobby",
+			expCode:    codes.NotFound,
+			expMessage: "unknown service",
+		},
+		{
+			name:       "instance refusing connections",
+			url:        "http://" + closedListener.Addr().String(),
+			expCode:    codes.Unavailable,
+			expMessage: "Bad Gateway",
+		},
+		{
+			name:       "no available instance",
+			url:        "http://" + listener.Addr().String(),
+			draining:   true,
+			expCode:    codes.Unavailable,
+			expMessage: "Service Unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := balancer.NewRoundRobin([]string{tt.url}, 5,
+				balancer.WithName("grpc"),
+				balancer.WithInstanceOptions(tt.url, balancer.InstanceOptions{Protocol: balancer.ProtocolH2C}),
+			)
+			assert.NoError(t, err)
+			if tt.draining {
+				assert.NoError(t, rr.SetDraining(tt.url, true))
+			}
+			lb := httptest.NewServer(h2c.NewHandler(GRPCStatus(rr), &http2.Server{}))
+			defer lb.Close()
+
+			conn, err := grpc.NewClient(lb.Listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+			assert.NoError(t, err)
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: tt.service})
+
+			st := status.Convert(err)
+			assert.Equal(t, tt.expCode, st.Code())
+			assert.Equal(t, tt.expMessage, st.Message())
+			if tt.expCode == codes.OK {
+				assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shedMetrics publishes the admitted and shed requests of every priority class at /debug/vars
+var shedMetrics = expvar.NewMap("loadShedding")
+
+// PriorityClass holds the load thresholds beyond which the requests of a class are shed.
+// Lower priority classes have lower thresholds so they are shed first.
+type PriorityClass struct {
+	Name string
+	// MaxInFlight sheds the class once the requests in flight through the load balancer reach it, 0 disables it
+	MaxInFlight int64
+	// MaxQueueWait sheds the class once the oldest request in the wait queue has waited that long, 0 disables it
+	MaxQueueWait time.Duration
+}
+
+// ClassStats counts the requests of a priority class
+type ClassStats struct {
+	Admitted int64 `json:"admitted"`
+	Shed     int64 `json:"shed"`
+}
+
+// LoadShedder drops the requests of the lower priority classes first when the load balancer is saturated
+type LoadShedder struct {
+	classes      map[string]PriorityClass
+	defaultClass string
+	header       string
+	trustHeader  func(r *http.Request) bool
+	routeClass   func(r *http.Request) string
+	queueWait    func(r *http.Request) time.Duration
+
+	inFlight int64
+	mu       sync.Mutex
+	stats    map[string]*ClassStats
+}
+
+// NewLoadShedder new a LoadShedder. The class of a request is taken from routeClass if it names a known class,
+// then from the header if trustHeader(r), so clients can't promote themselves, then defaultClass.
+// queueWait returns how long the oldest request queued in the pool of the request has waited.
+func NewLoadShedder(classes []PriorityClass, defaultClass, header string, trustHeader func(r *http.Request) bool, routeClass func(r *http.Request) string, queueWait func(r *http.Request) time.Duration) (*LoadShedder, error) {
+	s := &LoadShedder{
+		classes:      map[string]PriorityClass{},
+		defaultClass: defaultClass,
+		header:       header,
+		trustHeader:  trustHeader,
+		routeClass:   routeClass,
+		queueWait:    queueWait,
+		stats:        map[string]*ClassStats{},
+	}
+	for _, class := range classes {
+		s.classes[class.Name] = class
+		s.stats[class.Name] = &ClassStats{}
+		publishClassStats(class.Name, s)
+	}
+	if _, ok := s.classes[defaultClass]; !ok {
+		return nil, errors.New("unknown default priority class: " + defaultClass)
+	}
+	return s, nil
+}
+
+// Middleware implements mux.MiddlewareFunc
+func (s *LoadShedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := s.classOf(r)
+		inFlight := atomic.AddInt64(&s.inFlight, 1)
+		defer atomic.AddInt64(&s.inFlight, -1)
+
+		if s.shouldShed(r, class, inFlight) {
+			s.count(class.Name, false)
+			log.Printf("shed request of priority class %s: %s\n", class.Name, r.URL.Path)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.count(class.Name, true)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stats returns the request counts of every priority class
+func (s *LoadShedder) Stats() map[string]ClassStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := map[string]ClassStats{}
+	for name, cs := range s.stats {
+		stats[name] = *cs
+	}
+	return stats
+}
+
+// classOf returns the priority class of the request
+func (s *LoadShedder) classOf(r *http.Request) PriorityClass {
+	if s.routeClass != nil {
+		if class, ok := s.classes[s.routeClass(r)]; ok {
+			return class
+		}
+	}
+	if s.header != "" && s.trustHeader != nil && s.trustHeader(r) {
+		if class, ok := s.classes[r.Header.Get(s.header)]; ok {
+			return class
+		}
+	}
+	return s.classes[s.defaultClass]
+}
+
+// shouldShed checks the load against the thresholds of the class, inFlight includes the request itself
+func (s *LoadShedder) shouldShed(r *http.Request, class PriorityClass, inFlight int64) bool {
+	if class.MaxInFlight > 0 && inFlight > class.MaxInFlight {
+		return true
+	}
+	return class.MaxQueueWait > 0 && s.queueWait != nil && s.queueWait(r) >= class.MaxQueueWait
+}
+
+func (s *LoadShedder) count(class string, admitted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if admitted {
+		s.stats[class].Admitted++
+	} else {
+		s.stats[class].Shed++
+	}
+}
+
+// publishClassStats publishes the counts of the class, replacing any previous LoadShedder's
+func publishClassStats(class string, s *LoadShedder) {
+	shedMetrics.Set(class, expvar.Func(func() interface{} {
+		return s.Stats()[class]
+	}))
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadShedder(t *testing.T) {
+	t.Parallel()
+
+	classes := []PriorityClass{
+		{Name: "player"},
+		{Name: "default", MaxInFlight: 3, MaxQueueWait: 200 * time.Millisecond},
+		{Name: "analytics", MaxInFlight: 1, MaxQueueWait: 50 * time.Millisecond},
+	}
+	routeClass := func(r *http.Request) string {
+		if strings.HasPrefix(r.URL.Path, "/analytics") {
+			return "analytics"
+		}
+		return ""
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		header    string
+		trusted   bool
+		inFlight  int64
+		queueWait time.Duration
+		expCode   int
+		expClass  string
+	}{
+		{
+			name:     "default class under its threshold",
+			path:     "/echo",
+			inFlight: 2,
+			expCode:  http.StatusOK,
+			expClass: "default",
+		},
+		{
+			name:     "route class over its in-flight threshold",
+			path:     "/analytics/event",
+			inFlight: 1,
+			expCode:  http.StatusServiceUnavailable,
+			expClass: "analytics",
+		},
+		{
+			name:      "route class over its queue wait threshold",
+			path:      "/analytics/event",
+			queueWait: 100 * time.Millisecond,
+			expCode:   http.StatusServiceUnavailable,
+			expClass:  "analytics",
+		},
+		{
+			name:      "default class under its queue wait threshold",
+			path:      "/echo",
+			queueWait: 100 * time.Millisecond,
+			expCode:   http.StatusOK,
+			expClass:  "default",
+		},
+		{
+			name:     "route class takes precedence over the header class",
+			path:     "/analytics/event",
+			header:   "player",
+			trusted:  true,
+			inFlight: 1,
+			expCode:  http.StatusServiceUnavailable,
+			expClass: "analytics",
+		},
+		{
+			name:     "trusted header class without a route class",
+			path:     "/echo",
+			header:   "player",
+			trusted:  true,
+			inFlight: 100,
+			expCode:  http.StatusOK,
+			expClass: "player",
+		},
+		{
+			name:     "untrusted header class is ignored",
+			path:     "/echo",
+			header:   "player",
+			inFlight: 3,
+			expCode:  http.StatusServiceUnavailable,
+			expClass: "default",
+		},
+		{
+			name:     "unknown header class falls back to the default class",
+			path:     "/echo",
+			header:   "vip",
+			trusted:  true,
+			inFlight: 3,
+			expCode:  http.StatusServiceUnavailable,
+			expClass: "default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustHeader := func(r *http.Request) bool { return tt.trusted }
+			queueWait := func(r *http.Request) time.Duration { return tt.queueWait }
+			s, err := NewLoadShedder(classes, "default", "X-Priority", trustHeader, routeClass, queueWait)
+			assert.NoError(t, err)
+			// simulate the requests already in flight
+			s.inFlight = tt.inFlight
+			handler := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Priority", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.expCode, w.Code)
+
+			stats := s.Stats()[tt.expClass]
+			if tt.expCode == http.StatusOK {
+				assert.Equal(t, ClassStats{Admitted: 1}, stats)
+			} else {
+				assert.Equal(t, ClassStats{Shed: 1}, stats)
+			}
+		})
+	}
+}
+
+func TestNewLoadShedderUnknownDefaultClass(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewLoadShedder([]PriorityClass{{Name: "player"}}, "default", "", nil, nil, nil)
+	assert.EqualError(t, err, "unknown default priority class: default")
+}
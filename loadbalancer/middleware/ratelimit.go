@@ -0,0 +1,304 @@
+package middleware
+
+import (
+	"app/loadbalancer/jsonbody"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// KeyFunc extracts the key requests are grouped by, e.g., the client IP
+type KeyFunc func(r *http.Request) string
+
+// ParseKeyFunc parses the key of a rate limit:
+// "ip" for the client IP, "header:<name>" for a request header such as an API key,
+// "jwt-sub" for the subject of the bearer JWT, "body:<json path>" for a field of the JSON body such as "body:gamerID",
+// "route" or "global" for one key shared by all clients.
+// Requests without the header, the JWT or the body field fall back to the client IP.
+func ParseKeyFunc(key string) (KeyFunc, error) {
+	switch {
+	case key == "ip":
+		return ClientIP, nil
+	case key == "route" || key == "global":
+		return func(r *http.Request) string { return "" }, nil
+	case key == "jwt-sub":
+		return func(r *http.Request) string {
+			if sub := jwtSubject(r); sub != "" {
+				return "sub:" + sub
+			}
+			return "ip:" + ClientIP(r)
+		}, nil
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		name := strings.TrimPrefix(key, "header:")
+		return func(r *http.Request) string {
+			if value := r.Header.Get(name); value != "" {
+				return "header:" + value
+			}
+			return "ip:" + ClientIP(r)
+		}, nil
+	case strings.HasPrefix(key, "body:") && len(key) > len("body:"):
+		path := strings.TrimPrefix(key, "body:")
+		return func(r *http.Request) string {
+			if value, ok := jsonbody.Field(r, path); ok {
+				return "body:" + value
+			}
+			return "ip:" + ClientIP(r)
+		}, nil
+	}
+	return nil, errors.New("unknown rate limit key: " + key)
+}
+
+// KeyOptions holds how the keys of ParseVerifiedKeyFunc are verified
+type KeyOptions struct {
+	// JWTSecret verifies the HS256 signature of the bearer JWT of the "jwt-sub" key
+	JWTSecret []byte
+	// TrustedHeaders are the headers the load balancer sets itself from verified data,
+	// e.g., the client identity header of ClientAuth
+	TrustedHeaders []string
+}
+
+// ParseVerifiedKeyFunc parses a key like ParseKeyFunc for the limits a client must not escape by changing its key,
+// so only the keys the client can't choose are accepted: "jwt-sub" needs opts.JWTSecret and falls back to the client IP
+// when the JWT doesn't verify, "header:<name>" needs one of opts.TrustedHeaders and "body:<json path>" is rejected.
+func ParseVerifiedKeyFunc(key string, opts KeyOptions) (KeyFunc, error) {
+	switch {
+	case key == "jwt-sub":
+		if len(opts.JWTSecret) == 0 {
+			return nil, errors.New("the jwt-sub key needs a JWT secret to verify the tokens with")
+		}
+		return func(r *http.Request) string {
+			if sub := verifiedJWTSubject(r, opts.JWTSecret, time.Now()); sub != "" {
+				return "sub:" + sub
+			}
+			return "ip:" + ClientIP(r)
+		}, nil
+	case strings.HasPrefix(key, "header:"):
+		name := strings.TrimPrefix(key, "header:")
+		for _, trusted := range opts.TrustedHeaders {
+			if name != "" && strings.EqualFold(name, trusted) {
+				return ParseKeyFunc(key)
+			}
+		}
+		return nil, fmt.Errorf("the key %s is set by the clients, only the headers set by the load balancer such as the client identity header are trusted", key)
+	case strings.HasPrefix(key, "body:"):
+		return nil, fmt.Errorf("the key %s is set by the clients", key)
+	}
+	return ParseKeyFunc(key)
+}
+
+// ClientIP returns the IP of the client connection
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// jwtSubject returns the "sub" claim of the bearer JWT without verifying it, it's only used to group requests
+func jwtSubject(r *http.Request) string {
+	parts := bearerJWT(r)
+	if parts == nil {
+		return ""
+	}
+	claims := jwtClaims{}
+	if !decodeJWTPart(parts[1], &claims) {
+		return ""
+	}
+	return claims.Subject
+}
+
+// verifiedJWTSubject returns the "sub" claim of the bearer JWT if its HS256 signature verifies with secret
+// and it hasn't expired at now, and "" otherwise
+func verifiedJWTSubject(r *http.Request, secret []byte, now time.Time) string {
+	parts := bearerJWT(r)
+	if parts == nil {
+		return ""
+	}
+	header := struct {
+		Algorithm string `json:"alg"`
+	}{}
+	if !decodeJWTPart(parts[0], &header) || header.Algorithm != "HS256" {
+		return ""
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return ""
+	}
+	claims := jwtClaims{}
+	if !decodeJWTPart(parts[1], &claims) || (claims.ExpiresAt != 0 && now.Unix() >= claims.ExpiresAt) {
+		return ""
+	}
+	return claims.Subject
+}
+
+// jwtClaims holds the claims of a JWT used to key the requests
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// bearerJWT returns the header, payload and signature of the bearer JWT, nil if there is none
+func bearerJWT(r *http.Request) []string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	return parts
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a JWT into v
+func decodeJWTPart(part string, v interface{}) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+// RateLimitPolicy is the token bucket settings of a group of requests
+type RateLimitPolicy struct {
+	// Name separates the buckets of different policies, e.g., the route path prefix
+	Name string
+	Key  KeyFunc
+	// Burst is the bucket size and Rate is the number of tokens refilled per second
+	Burst int
+	Rate  float64
+}
+
+// tokenBucket holds the tokens left at the last update
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	burst  float64
+	rate   float64
+}
+
+// refill adds the tokens refilled since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// RateLimiter keeps the token buckets of all policies and keys
+type RateLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// rateLimitSweepInterval is how often the refilled buckets are removed
+const rateLimitSweepInterval = time.Minute
+
+// NewRateLimiter new an empty RateLimiter
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		now:       time.Now,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Middleware returns a middleware applying the policy policy(r) returns, requests without a policy are not limited.
+// Limited requests get 429 with the Retry-After header, and all responses get the RateLimit-* headers.
+func (l *RateLimiter) Middleware(policy func(r *http.Request) *RateLimitPolicy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := policy(r)
+			if p == nil || p.Burst <= 0 || p.Rate <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			allowed, remaining, reset, retryAfter := l.take(p.Name+"|"+p.Key(r), *p)
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(p.Burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+			if !allowed {
+				log.Printf("rate limit exceeded: %s\n", r.URL.Path)
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// take refills the bucket of the key and takes a token from it.
+// It returns whether a token was taken, the tokens left, the time until the bucket is full and the time until the next token.
+func (l *RateLimiter) take(key string, p RateLimitPolicy) (bool, int, time.Duration, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(p.Burst), last: now}
+		l.buckets[key] = b
+	}
+	// pick up the policy changes
+	b.burst, b.rate = float64(p.Burst), p.Rate
+	b.refill(now)
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	reset := secondsToDuration((b.burst - b.tokens) / b.rate)
+	retryAfter := secondsToDuration((1 - b.tokens) / b.rate)
+	return allowed, int(b.tokens), reset, retryAfter
+}
+
+// sweep removes the buckets refilled to full since their last use, they behave the same as new ones
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// size returns the number of buckets kept
+func (l *RateLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// ceilSeconds rounds a duration up to whole seconds for the headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyFunc(t *testing.T) {
+	t.Parallel()
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"gamer-1"}`))
+	jwt := "eyJhbGciOiJIUzI1NiJ9." + payload + ".signature"
+
+	tests := []struct {
+		name    string
+		key     string
+		headers map[string]string
+		body    string
+		exp     string
+		expErr  bool
+	}{
+		{name: "client ip", key: "ip", exp: "192.0.2.1"},
+		{name: "route", key: "route", exp: ""},
+		{name: "api key header", key: "header:X-API-Key", headers: map[string]string{"X-API-Key": "abc"}, exp: "header:abc"},
+		{name: "missing api key header", key: "header:X-API-Key", exp: "ip:192.0.2.1"},
+		{name: "jwt subject", key: "jwt-sub", headers: map[string]string{"Authorization": "Bearer " + jwt}, exp: "sub:gamer-1"},
+		{name: "malformed jwt", key: "jwt-sub", headers: map[string]string{"Authorization": "Bearer abc"}, exp: "ip:192.0.2.1"},
+		{name: "body field", key: "body:gamerID", body: `{"game":"Mobile Legends","gamerID":"GYUTDTE"}`, exp: "body:GYUTDTE"},
+		{name: "malformed body", key: "body:gamerID", body: `{"gamerID":`, exp: "ip:192.0.2.1"},
+		{name: "unknown key", key: "cookie", expErr: true},
+		{name: "header without name", key: "header:", expErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFunc, err := ParseKeyFunc(tt.key)
+			if tt.expErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			r := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.exp, keyFunc(r))
+		})
+	}
+}
+
+// signJWT returns an HS256 JWT of the claims signed with secret
+func signJWT(claims string, secret []byte) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseVerifiedKeyFunc(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("secret")
+	opts := KeyOptions{JWTSecret: secret, TrustedHeaders: []string{"X-Client-Identity"}}
+	unsigned := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"gamer-1"}`)) + "."
+
+	tests := []struct {
+		name    string
+		key     string
+		opts    KeyOptions
+		headers map[string]string
+		exp     string
+		expErr  bool
+	}{
+		{name: "client ip", key: "ip", opts: opts, exp: "192.0.2.1"},
+		{name: "verified jwt subject", key: "jwt-sub", opts: opts, headers: map[string]string{"Authorization": "Bearer " + signJWT(`{"sub":"gamer-1"}`, secret)}, exp: "sub:gamer-1"},
+		{name: "jwt signed with another secret", key: "jwt-sub", opts: opts, headers: map[string]string{"Authorization": "Bearer " + signJWT(`{"sub":"gamer-1"}`, []byte("other"))}, exp: "ip:192.0.2.1"},
+		{name: "unsigned jwt", key: "jwt-sub", opts: opts, headers: map[string]string{"Authorization": "Bearer " + unsigned}, exp: "ip:192.0.2.1"},
+		{name: "expired jwt", key: "jwt-sub", opts: opts, headers: map[string]string{"Authorization": "Bearer " + signJWT(`{"sub":"gamer-1","exp":1}`, secret)}, exp: "ip:192.0.2.1"},
+		{name: "jwt subject without secret", key: "jwt-sub", expErr: true},
+		{name: "trusted header", key: "header:x-client-identity", opts: opts, headers: map[string]string{"X-Client-Identity": "CN=api"}, exp: "header:CN=api"},
+		{name: "header set by the clients", key: "header:X-API-Key", opts: opts, expErr: true},
+		{name: "body field", key: "body:gamerID", opts: opts, expErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFunc, err := ParseVerifiedKeyFunc(tt.key, tt.opts)
+			if tt.expErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.exp, keyFunc(r))
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limiter.lastSweep = now
+
+	policy := &RateLimitPolicy{Name: "/echo", Key: ClientIP, Burst: 2, Rate: 0.5}
+	handler := limiter.Middleware(func(r *http.Request) *RateLimitPolicy { return policy })(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("192.0.2.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Reset"))
+
+	assert.Equal(t, http.StatusOK, send("192.0.2.1:1234").Code)
+	w = send("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	// other clients have their own bucket
+	assert.Equal(t, http.StatusOK, send("192.0.2.2:1234").Code)
+
+	// a token is refilled after 2s
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, http.StatusOK, send("192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("192.0.2.1:1234").Code)
+	assert.Equal(t, 2, limiter.size())
+
+	// refilled buckets are removed by the sweep
+	now = now.Add(rateLimitSweepInterval)
+	assert.Equal(t, http.StatusOK, send("192.0.2.3:1234").Code)
+	assert.Equal(t, 1, limiter.size())
+}
@@ -0,0 +1,235 @@
+package mirror
+
+import (
+	"app/loadbalancer/balancer"
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mirrorMetrics publishes the Stats of every mirror at /debug/vars
+var mirrorMetrics = expvar.NewMap("mirrors")
+
+// Options holds which requests are mirrored and the limits of the shadow requests
+type Options struct {
+	// Percent is the share of the requests mirrored, 0 mirrors none, default 100 if nil
+	Percent *float64
+	// MaxBodyBytes is the largest request body buffered to be mirrored, larger requests are not mirrored, default 1MB
+	MaxBodyBytes int64
+	// Timeout bounds the shadow requests, default 10s
+	Timeout time.Duration
+	// MaxInFlight is the number of shadow requests in flight beyond which requests are not mirrored, default 100
+	MaxInFlight int64
+}
+
+// Stats is a snapshot of the shadow requests of a mirror
+type Stats struct {
+	// Mirrored counts the shadow requests sent, Skipped the sampled requests not mirrored for their body size or the in-flight limit
+	Mirrored int64 `json:"mirrored"`
+	Skipped  int64 `json:"skipped"`
+	// Succeeded counts the shadow requests without a 5xx response, Mismatches the ones whose status differs from the primary's
+	Succeeded  int64 `json:"succeeded"`
+	Mismatches int64 `json:"mismatches"`
+	// TotalLatencyDiff is the sum of the shadow response time minus the primary response time
+	TotalLatencyDiff time.Duration `json:"totalLatencyDiffNs"`
+	InFlight         int64         `json:"inFlight"`
+}
+
+// Mirror sends a copy of the requests to a shadow pool, the responses of the shadow pool are discarded
+type Mirror struct {
+	name   string
+	shadow http.Handler
+	opts   Options
+	// percent is the share of the requests mirrored in [0, 100]
+	percent float64
+
+	inFlight int64
+	mu       sync.Mutex
+	stats    Stats
+}
+
+// NewMirror new a Mirror sending the copies to shadow, its stats are published under its name
+func NewMirror(name string, shadow http.Handler, opts Options) *Mirror {
+	percent := 100.0
+	if opts.Percent != nil {
+		percent = math.Max(0, math.Min(100, *opts.Percent))
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 1 << 20
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = 100
+	}
+	m := &Mirror{name: name, shadow: shadow, opts: opts, percent: percent}
+	mirrorMetrics.Set(name, expvar.Func(func() interface{} {
+		return m.Stats()
+	}))
+	return m
+}
+
+// Middleware implements mux.MiddlewareFunc, next serves the primary response to the client.
+// Upgrade requests are not mirrored, a connection can't be switched to two protocols.
+func (m *Mirror) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if balancer.IsUpgrade(r) || (m.percent < 100 && rand.Float64()*100 >= m.percent) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		shadow, cancel, ok := m.shadowRequest(r)
+		if !ok {
+			m.count(func(s *Stats) { s.Skipped++ })
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		primary := make(chan response, 1)
+		go m.send(shadow, cancel, primary)
+
+		rec := balancer.NewStatusRecorder(w)
+		startTime := time.Now()
+		defer func() {
+			// sent even if the proxy aborts the response with a panic, so the shadow request doesn't wait forever
+			primary <- response{status: rec.Status(), latency: rec.Elapsed(startTime)}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// response is the status and the response time of a request
+type response struct {
+	status  int
+	latency time.Duration
+}
+
+// shadowRequest buffers the body of r and returns a copy of r detached from the client,
+// it returns false if the body is too large or too many shadow requests are in flight
+func (m *Mirror) shadowRequest(r *http.Request) (*http.Request, context.CancelFunc, bool) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, m.opts.MaxBodyBytes+1))
+		// the primary still gets the whole body, including the part not read or the read error
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || int64(len(body)) > m.opts.MaxBodyBytes {
+			return nil, nil, false
+		}
+	}
+	if atomic.AddInt64(&m.inFlight, 1) > m.opts.MaxInFlight {
+		atomic.AddInt64(&m.inFlight, -1)
+		return nil, nil, false
+	}
+
+	// the shadow request outlives the client request, so it doesn't share its cancellation,
+	// but it keeps the values such as the header and rewrite policies applied by the balancer
+	ctx, cancel := context.WithTimeout(valueOnlyContext{r.Context()}, m.opts.Timeout)
+	shadow := r.Clone(ctx)
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	return shadow, cancel, true
+}
+
+// send serves the shadow request and records its result against the primary response
+func (m *Mirror) send(shadow *http.Request, cancel context.CancelFunc, primary <-chan response) {
+	defer atomic.AddInt64(&m.inFlight, -1)
+	defer cancel()
+
+	w := &discardWriter{header: http.Header{}, status: http.StatusOK}
+	startTime := time.Now()
+	m.shadow.ServeHTTP(w, shadow)
+	latency := time.Since(startTime)
+
+	p := <-primary
+	m.count(func(s *Stats) {
+		s.Mirrored++
+		if w.status < http.StatusInternalServerError {
+			s.Succeeded++
+		}
+		if w.status != p.status {
+			s.Mismatches++
+		}
+		s.TotalLatencyDiff += latency - p.latency
+	})
+	if w.status != p.status {
+		log.Printf("mirror %s responded %d while the primary responded %d: %s\n", m.name, w.status, p.status, shadow.URL.Path)
+	}
+}
+
+// Stats returns a snapshot of the shadow requests
+func (m *Mirror) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.InFlight = atomic.LoadInt64(&m.inFlight)
+	return stats
+}
+
+func (m *Mirror) count(update func(s *Stats)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	update(&m.stats)
+}
+
+// valueOnlyContext keeps the values of its parent without its deadline and cancellation, like context.WithoutCancel
+type valueOnlyContext struct {
+	parent context.Context
+}
+
+// Deadline implements context.Context
+func (c valueOnlyContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done implements context.Context
+func (c valueOnlyContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err implements context.Context
+func (c valueOnlyContext) Err() error {
+	return nil
+}
+
+// Value implements context.Context
+func (c valueOnlyContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// discardWriter is the http.ResponseWriter of the shadow requests, it only keeps the status
+type discardWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+}
+
+// Header implements http.ResponseWriter
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+// Write implements http.ResponseWriter
+func (w *discardWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return len(b), nil
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *discardWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= http.StatusOK {
+		w.status = status
+		w.wroteHeader = true
+	}
+}
@@ -0,0 +1,166 @@
+package mirror
+
+import (
+	"app/loadbalancer/rewrite"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoHandler responds the request body with the status, and sends the body to bodies if not nil
+func echoHandler(status int, bodies chan<- string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bodies != nil {
+			bodies <- string(body)
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	})
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		shadowStatus int
+		body         string
+		expShadow    bool
+		expStats     Stats
+	}{
+		{
+			name:         "shadow responds the same status",
+			shadowStatus: http.StatusOK,
+			body:         `{"game":"Mobile Legends"}`,
+			expShadow:    true,
+			expStats:     Stats{Mirrored: 1, Succeeded: 1},
+		},
+		{
+			name:         "shadow fails",
+			shadowStatus: http.StatusBadGateway,
+			body:         `{"game":"Mobile Legends"}`,
+			expShadow:    true,
+			expStats:     Stats{Mirrored: 1, Mismatches: 1},
+		},
+		{
+			name:         "body over the limit is not mirrored",
+			shadowStatus: http.StatusOK,
+			body:         strings.Repeat("a", 65),
+			expStats:     Stats{Skipped: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shadowBodies := make(chan string, 1)
+			m := NewMirror("test-"+tt.name, echoHandler(tt.shadowStatus, shadowBodies), Options{MaxBodyBytes: 64})
+
+			w := httptest.NewRecorder()
+			m.Middleware(echoHandler(http.StatusOK, nil)).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(tt.body)))
+			// the client gets the primary response with the whole body either way
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.body, w.Body.String())
+
+			if tt.expShadow {
+				select {
+				case body := <-shadowBodies:
+					assert.Equal(t, tt.body, body)
+				case <-time.After(time.Second):
+					t.Fatal("the shadow request is not sent")
+				}
+			}
+			assert.Eventually(t, func() bool {
+				stats := m.Stats()
+				stats.TotalLatencyDiff = 0
+				return stats == tt.expStats
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestMirrorMaxInFlight(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release })
+	m := NewMirror("test-max-in-flight", shadow, Options{MaxInFlight: 1})
+
+	handler := m.Middleware(echoHandler(http.StatusOK, nil))
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("{}")))
+	}
+	stats := m.Stats()
+	assert.Equal(t, int64(1), stats.InFlight)
+	assert.Equal(t, int64(2), stats.Skipped)
+
+	close(release)
+	assert.Eventually(t, func() bool { return m.Stats().Mirrored == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestMirrorKeepsContextValues(t *testing.T) {
+	t.Parallel()
+
+	policy, err := rewrite.NewPolicy(rewrite.Options{StripPrefix: "/v1"})
+	assert.NoError(t, err)
+	paths := make(chan string, 1)
+	// the shadow pool applies the rewrite policy of the request context like the balancer does
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rewrite.Apply(r)
+		assert.NoError(t, r.Context().Err())
+		paths <- r.URL.Path
+	})
+	m := NewMirror("test-context-values", shadow, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := rewrite.Middleware(func(r *http.Request) *rewrite.Policy { return policy })(m.Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the client going away doesn't cancel the shadow request
+			cancel()
+		}),
+	))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/echo", nil).WithContext(ctx))
+
+	select {
+	case path := <-paths:
+		assert.Equal(t, "/echo", path)
+	case <-time.After(time.Second):
+		t.Fatal("the shadow request is not sent")
+	}
+}
+
+func TestMirrorPercent(t *testing.T) {
+	t.Parallel()
+
+	zero, half := 0.0, 50.0
+	tests := []struct {
+		name    string
+		percent *float64
+		expMin  int64
+		expMax  int64
+	}{
+		{name: "default mirrors all", percent: nil, expMin: 100, expMax: 100},
+		{name: "zero mirrors none", percent: &zero, expMin: 0, expMax: 0},
+		{name: "half", percent: &half, expMin: 1, expMax: 99},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMirror("test-percent-"+tt.name, echoHandler(http.StatusOK, nil), Options{Percent: tt.percent})
+			handler := m.Middleware(echoHandler(http.StatusOK, nil))
+			for i := 0; i < 100; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/echo", nil))
+			}
+			assert.Eventually(t, func() bool { return m.Stats().InFlight == 0 }, time.Second, 10*time.Millisecond)
+			mirrored := m.Stats().Mirrored
+			assert.GreaterOrEqual(t, mirrored, tt.expMin)
+			assert.LessOrEqual(t, mirrored, tt.expMax)
+		})
+	}
+}
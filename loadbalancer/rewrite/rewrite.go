@@ -0,0 +1,136 @@
+package rewrite
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Options holds the URL changes of a route, the path is rewritten in the order PathRegex, StripPrefix then AddPrefix
+type Options struct {
+	// PathRegex is replaced by PathReplacement in the path, which may refer to the captures as $1 or ${name}
+	PathRegex       string
+	PathReplacement string
+	// StripPrefix is removed from the start of the path, AddPrefix is added to it
+	StripPrefix string
+	AddPrefix   string
+	// Host replaces the Host header sent upstream, or the host of the redirect location
+	Host string
+	// RedirectStatus responds a redirect to the rewritten URL instead of proxying, 301, 302, 307 or 308, 0 disables it
+	RedirectStatus int
+	// RedirectScheme is the scheme of the redirect location, default the scheme of the request
+	RedirectScheme string
+}
+
+// Policy is the compiled URL changes of a route
+type Policy struct {
+	opts      Options
+	pathRegex *regexp.Regexp
+}
+
+// NewPolicy new a Policy of the options
+func NewPolicy(opts Options) (*Policy, error) {
+	p := &Policy{opts: opts}
+	if opts.PathRegex != "" {
+		pathRegex, err := regexp.Compile(opts.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex: %w", err)
+		}
+		p.pathRegex = pathRegex
+	}
+	switch opts.RedirectStatus {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("invalid redirect status: %d", opts.RedirectStatus)
+	}
+	return p, nil
+}
+
+// Path returns the rewritten path
+func (p *Policy) Path(path string) string {
+	if p.pathRegex != nil {
+		path = p.pathRegex.ReplaceAllString(path, p.opts.PathReplacement)
+	}
+	if p.opts.StripPrefix != "" && strings.HasPrefix(path, p.opts.StripPrefix) {
+		path = strings.TrimPrefix(path, p.opts.StripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if p.opts.AddPrefix != "" {
+		path = strings.TrimSuffix(p.opts.AddPrefix, "/") + path
+	}
+	return path
+}
+
+// location returns the redirect location of the request, absolute if the host or the scheme changes
+func (p *Policy) location(r *http.Request) string {
+	u := *r.URL
+	u.Path = p.Path(r.URL.Path)
+	u.RawPath = ""
+	if p.opts.Host == "" && p.opts.RedirectScheme == "" {
+		u.Scheme = ""
+		u.Host = ""
+		return u.String()
+	}
+	u.Host = p.opts.Host
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	u.Scheme = p.opts.RedirectScheme
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	return u.String()
+}
+
+// contextKey is the context key of the policy of a request
+type contextKey struct{}
+
+// Middleware responds the redirects, and stores the policy of the other requests in their context for Apply
+func Middleware(policy func(r *http.Request) *Policy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := policy(r)
+			if p == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if p.opts.RedirectStatus != 0 {
+				http.Redirect(w, r, p.location(r), p.opts.RedirectStatus)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, p)))
+		})
+	}
+}
+
+// Redirects returns a matcher of the requests responded a redirect by their policy, so a router lets them reach
+// the Middleware whatever their method
+func Redirects(policy func(r *http.Request) *Policy) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		p := policy(r)
+		return p != nil && p.opts.RedirectStatus != 0
+	}
+}
+
+// Apply rewrites the path and the host of the request going upstream by the policy in its context,
+// it must be called before the path is joined with the instance's
+func Apply(r *http.Request) {
+	p, ok := r.Context().Value(contextKey{}).(*Policy)
+	if !ok {
+		return
+	}
+	r.URL.Path = p.Path(r.URL.Path)
+	r.URL.RawPath = ""
+	if p.opts.Host != "" {
+		r.Host = p.opts.Host
+	}
+}
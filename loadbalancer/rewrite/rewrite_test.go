@@ -0,0 +1,178 @@
+package rewrite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyPath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		opts Options
+		path string
+		exp  string
+	}{
+		{
+			name: "strip prefix",
+			opts: Options{StripPrefix: "/v1"},
+			path: "/v1/echo",
+			exp:  "/echo",
+		},
+		{
+			name: "strip the whole path",
+			opts: Options{StripPrefix: "/v1"},
+			path: "/v1",
+			exp:  "/",
+		},
+		{
+			name: "add prefix",
+			opts: Options{AddPrefix: "/api/"},
+			path: "/echo",
+			exp:  "/api/echo",
+		},
+		{
+			name: "regex with captures",
+			opts: Options{PathRegex: `^/games/([^/]+)/echo$`, PathReplacement: "/echo/$1"},
+			path: "/games/mlbb/echo",
+			exp:  "/echo/mlbb",
+		},
+		{
+			name: "regex then strip then add",
+			opts: Options{PathRegex: `^/old/`, PathReplacement: "/v1/", StripPrefix: "/v1", AddPrefix: "/v2"},
+			path: "/old/echo",
+			exp:  "/v2/echo",
+		},
+		{
+			name: "path without the prefix",
+			opts: Options{StripPrefix: "/v1"},
+			path: "/echo",
+			exp:  "/echo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPolicy(tt.opts)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.exp, p.Path(tt.path))
+		})
+	}
+}
+
+func TestMiddlewareRedirect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		opts        Options
+		target      string
+		expCode     int
+		expLocation string
+	}{
+		{
+			name:        "permanent redirect to the stripped path",
+			opts:        Options{StripPrefix: "/v1", RedirectStatus: http.StatusPermanentRedirect},
+			target:      "/v1/echo?game=mlbb",
+			expCode:     http.StatusPermanentRedirect,
+			expLocation: "/echo?game=mlbb",
+		},
+		{
+			name:        "moved to another host over https",
+			opts:        Options{Host: "api.example.com", RedirectScheme: "https", RedirectStatus: http.StatusMovedPermanently},
+			target:      "/echo",
+			expCode:     http.StatusMovedPermanently,
+			expLocation: "https://api.example.com/echo",
+		},
+		{
+			name:    "no redirect",
+			opts:    Options{StripPrefix: "/v1"},
+			target:  "/v1/echo",
+			expCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPolicy(tt.opts)
+			assert.NoError(t, err)
+			handler := Middleware(func(r *http.Request) *Policy { return p })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.target, nil))
+			assert.Equal(t, tt.expCode, w.Code)
+			assert.Equal(t, tt.expLocation, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	t.Parallel()
+
+	redirect, err := NewPolicy(Options{StripPrefix: "/v1", RedirectStatus: http.StatusPermanentRedirect})
+	assert.NoError(t, err)
+	policy := func(r *http.Request) *Policy {
+		if strings.HasPrefix(r.URL.Path, "/v1/") {
+			return redirect
+		}
+		return nil
+	}
+	// a router proxying only the POST requests, like the load balancer's
+	router := mux.NewRouter()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	router.PathPrefix("/").MatcherFunc(Redirects(policy)).HandlerFunc(noop)
+	router.PathPrefix("/").Methods(http.MethodPost).HandlerFunc(noop)
+	router.Use(Middleware(policy))
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		expCode int
+	}{
+		{name: "GET redirected", method: http.MethodGet, target: "/v1/echo", expCode: http.StatusPermanentRedirect},
+		{name: "HEAD redirected", method: http.MethodHead, target: "/v1/echo", expCode: http.StatusPermanentRedirect},
+		{name: "POST redirected", method: http.MethodPost, target: "/v1/echo", expCode: http.StatusPermanentRedirect},
+		{name: "GET without redirect", method: http.MethodGet, target: "/echo", expCode: http.StatusMethodNotAllowed},
+		{name: "POST without redirect", method: http.MethodPost, target: "/echo", expCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			assert.Equal(t, tt.expCode, w.Code)
+		})
+	}
+}
+
+func TestMiddlewareApply(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewPolicy(Options{StripPrefix: "/v1", Host: "echo.internal"})
+	assert.NoError(t, err)
+
+	var upstream *http.Request
+	handler := Middleware(func(r *http.Request) *Policy { return p })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the director of the proxy applies the policy to the outgoing request
+		upstream = r.Clone(r.Context())
+		Apply(upstream)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/echo", nil))
+	assert.Equal(t, "/echo", upstream.URL.Path)
+	assert.Equal(t, "echo.internal", upstream.Host)
+}
+
+func TestNewPolicyInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewPolicy(Options{PathRegex: "("})
+	assert.Error(t, err)
+	_, err = NewPolicy(Options{RedirectStatus: http.StatusOK})
+	assert.Error(t, err)
+}
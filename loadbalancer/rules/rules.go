@@ -0,0 +1,106 @@
+package rules
+
+import (
+	"app/loadbalancer/jsonbody"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Rule sends the requests matching all of its conditions to a pool, conditions not set match any request
+type Rule struct {
+	// Headers match the requests with all the header values, e.g., "X-Game": "MobileLegends"
+	Headers map[string]string
+	// Query match the requests with all the query parameter values, e.g., "region": "sea"
+	Query map[string]string
+	// PathRegex matches the requests whose path matches the regular expression
+	PathRegex string
+	// Body match the requests with all the values at the JSON paths into the body, e.g., "game": "Mobile Legends".
+	// Malformed bodies and bodies larger than jsonbody.MaxBytes match no body condition.
+	Body map[string]string
+	// Pool is the name of the pool the matching requests are sent to
+	Pool string
+}
+
+// compiledRule is a Rule with its path regular expression compiled and its pool resolved
+type compiledRule struct {
+	Rule
+	pathRegex *regexp.Regexp
+	handler   http.Handler
+}
+
+// matches reports whether the request meets all the conditions of the rule, body returns the parsed JSON body
+func (c *compiledRule) matches(r *http.Request, body func() interface{}) bool {
+	for name, value := range c.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	if len(c.Query) > 0 {
+		query := r.URL.Query()
+		for name, value := range c.Query {
+			if query.Get(name) != value {
+				return false
+			}
+		}
+	}
+	if c.pathRegex != nil && !c.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	for path, value := range c.Body {
+		if v, ok := jsonbody.Lookup(body(), path); !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Engine evaluates the rules in order, the first matching rule picks the pool of a request
+type Engine struct {
+	rules []compiledRule
+}
+
+// NewEngine new an Engine of the rules, whose pools are looked up in pools
+func NewEngine(rules []Rule, pools map[string]http.Handler) (*Engine, error) {
+	e := &Engine{}
+	for i, rule := range rules {
+		c := compiledRule{Rule: rule}
+		handler, ok := pools[rule.Pool]
+		if !ok {
+			return nil, fmt.Errorf("unknown pool %s in rule %d", rule.Pool, i)
+		}
+		c.handler = handler
+		if rule.PathRegex != "" {
+			pathRegex, err := regexp.Compile(rule.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path regex in rule %d: %w", i, err)
+			}
+			c.pathRegex = pathRegex
+		}
+		e.rules = append(e.rules, c)
+	}
+	return e, nil
+}
+
+// Match returns the pool of the first rule the request matches, false if none matches and the request goes to the default
+func (e *Engine) Match(r *http.Request) (http.Handler, bool) {
+	if e == nil {
+		return nil, false
+	}
+	// the body is read once by the first rule with a body condition
+	var doc interface{}
+	parsed := false
+	body := func() interface{} {
+		if !parsed {
+			doc, _ = jsonbody.Read(r)
+			parsed = true
+		}
+		return doc
+	}
+	for i := range e.rules {
+		if e.rules[i].matches(r, body) {
+			return e.rules[i].handler, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,178 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// poolHandler responds the pool name in the body
+func poolHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	})
+}
+
+func TestEngineMatch(t *testing.T) {
+	t.Parallel()
+
+	pools := map[string]http.Handler{
+		"a": poolHandler("a"),
+		"b": poolHandler("b"),
+		"c": poolHandler("c"),
+		"d": poolHandler("d"),
+	}
+	e, err := NewEngine([]Rule{
+		{Headers: map[string]string{"X-Game": "MobileLegends"}, Query: map[string]string{"region": "sea"}, Pool: "d"},
+		{Headers: map[string]string{"X-Game": "MobileLegends"}, Pool: "a"},
+		{Query: map[string]string{"region": "sea"}, Pool: "b"},
+		{PathRegex: `^/v[0-9]+/echo$`, Pool: "c"},
+	}, pools)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		target  string
+		header  string
+		expPool string
+	}{
+		{
+			name:    "all conditions of the first rule",
+			target:  "/echo?region=sea",
+			header:  "MobileLegends",
+			expPool: "d",
+		},
+		{
+			name:    "header rule before query rule",
+			target:  "/echo?region=eu",
+			header:  "MobileLegends",
+			expPool: "a",
+		},
+		{
+			name:    "query rule before path rule",
+			target:  "/v1/echo?region=sea",
+			expPool: "b",
+		},
+		{
+			name:    "path regex rule",
+			target:  "/v2/echo",
+			expPool: "c",
+		},
+		{
+			name:    "header value differs",
+			target:  "/echo",
+			header:  "PUBG",
+			expPool: "",
+		},
+		{
+			name:    "no rule matches",
+			target:  "/v1/echo/extra",
+			expPool: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Game", tt.header)
+			}
+			handler, ok := e.Match(r)
+			assert.Equal(t, tt.expPool != "", ok)
+			if ok {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				assert.Equal(t, tt.expPool, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewEngineInvalidRule(t *testing.T) {
+	t.Parallel()
+
+	pools := map[string]http.Handler{"a": poolHandler("a")}
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{
+			name: "unknown pool",
+			rule: Rule{PathRegex: "^/echo", Pool: "b"},
+		},
+		{
+			name: "invalid path regex",
+			rule: Rule{PathRegex: "(", Pool: "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEngine([]Rule{tt.rule}, pools)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNilEngineMatch(t *testing.T) {
+	t.Parallel()
+
+	_, ok := (*Engine)(nil).Match(httptest.NewRequest(http.MethodPost, "/echo", nil))
+	assert.False(t, ok)
+}
+
+func TestEngineMatchBody(t *testing.T) {
+	t.Parallel()
+
+	pools := map[string]http.Handler{
+		"a": poolHandler("a"),
+		"b": poolHandler("b"),
+	}
+	e, err := NewEngine([]Rule{
+		{Body: map[string]string{"game": "Mobile Legends", "region": "sea"}, Pool: "a"},
+		{Body: map[string]string{"game": "Mobile Legends"}, Pool: "b"},
+	}, pools)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		body    string
+		expPool string
+	}{
+		{
+			name:    "all body conditions of the first rule",
+			body:    `{"game":"Mobile Legends","region":"sea"}`,
+			expPool: "a",
+		},
+		{
+			name:    "body condition of the second rule",
+			body:    `{"game":"Mobile Legends","region":"eu"}`,
+			expPool: "b",
+		},
+		{
+			name: "malformed body goes to the default",
+			body: `{"game":"Mobile Legends"`,
+		},
+		{
+			name: "oversized body goes to the default",
+			body: `{"game":"Mobile Legends","padding":"` + strings.Repeat("a", 1<<16) + `"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(tt.body))
+			handler, ok := e.Match(r)
+			assert.Equal(t, tt.expPool != "", ok)
+			if ok {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				assert.Equal(t, tt.expPool, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package split
+
+import (
+	"app/loadbalancer/balancer"
+	"app/loadbalancer/middleware"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// splitMetrics publishes the VariantStats of every split at /debug/vars
+var splitMetrics = expvar.NewMap("splits")
+
+// Variant is a backend pool taking a share of the traffic of a split
+type Variant struct {
+	// Name is the name of the pool, it's also the value forcing the variant in the override header or cookie
+	Name    string
+	Handler http.Handler
+	// Weight is the share of the variant relative to the other variants', e.g., 95 and 5
+	Weight float64
+}
+
+// Options holds how a request is assigned a variant
+type Options struct {
+	// Header and Cookie name a request header and a cookie whose value forces the variant of that name, ignored if empty
+	Header string
+	Cookie string
+	// Key returns the key of the client, a client is always assigned the same variant while the weights don't change.
+	// The clients of the last variant keep it when its weight is raised. Requests are assigned at random if nil.
+	Key middleware.KeyFunc
+	// Observe is called with the result of every request not forced by the header or the cookie, e.g., by the canary analysis
+	Observe func(variant string, failed bool, latency time.Duration)
+}
+
+// VariantStats is a snapshot of the weight and the requests of a variant
+type VariantStats struct {
+	Weight float64 `json:"weight"`
+	// Requests counts the requests sent to the variant, Forced the ones forced by the header or the cookie
+	Requests int64 `json:"requests"`
+	Forced   int64 `json:"forced"`
+	// Errors counts the 5xx responses
+	Errors int64 `json:"errors"`
+	// TotalLatency is the sum of the response time of the requests
+	TotalLatency time.Duration `json:"totalLatencyNs"`
+}
+
+// Splitter sends the requests of a route to the variants by their weights
+type Splitter struct {
+	name string
+	opts Options
+
+	mu       sync.RWMutex
+	variants []Variant
+	stats    map[string]*VariantStats
+}
+
+// NewSplitter new a Splitter, its stats are published under its name
+func NewSplitter(name string, variants []Variant, opts Options) (*Splitter, error) {
+	if len(variants) == 0 {
+		return nil, errors.New("the variant list of split " + name + " is empty")
+	}
+	s := &Splitter{
+		name:     name,
+		opts:     opts,
+		variants: append([]Variant{}, variants...),
+		stats:    map[string]*VariantStats{},
+	}
+	for _, v := range variants {
+		if _, ok := s.stats[v.Name]; ok {
+			return nil, fmt.Errorf("duplicate variant %s in split %s", v.Name, name)
+		}
+		s.stats[v.Name] = &VariantStats{}
+	}
+	if err := checkWeights(s.variants); err != nil {
+		return nil, err
+	}
+	splitMetrics.Set(name, expvar.Func(func() interface{} {
+		return s.Stats()
+	}))
+	return s, nil
+}
+
+// checkWeights checks the weights are not negative and not all 0
+func checkWeights(variants []Variant) error {
+	total := float64(0)
+	for _, v := range variants {
+		if v.Weight < 0 {
+			return fmt.Errorf("negative weight of variant %s", v.Name)
+		}
+		total += v.Weight
+	}
+	if total == 0 {
+		return errors.New("the weights of all variants are 0")
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *Splitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	variant, forced := s.variantOf(r)
+	rec := balancer.NewStatusRecorder(w)
+	startTime := time.Now()
+	variant.Handler.ServeHTTP(rec, r)
+	latency := rec.Elapsed(startTime)
+	s.count(variant.Name, forced, !rec.Succeeded(), latency)
+	if s.opts.Observe != nil && !forced {
+		s.opts.Observe(variant.Name, !rec.Succeeded(), latency)
+	}
+}
+
+// variantOf returns the variant of the request and whether it's forced by the header or the cookie
+func (s *Splitter) variantOf(r *http.Request) (Variant, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if name := s.override(r); name != "" {
+		for _, v := range s.variants {
+			if v.Name == name {
+				return v, true
+			}
+		}
+	}
+
+	total := float64(0)
+	for _, v := range s.variants {
+		total += v.Weight
+	}
+	point := s.bucket(r) * total
+	for _, v := range s.variants {
+		if point < v.Weight {
+			return v, false
+		}
+		point -= v.Weight
+	}
+	// rounding put the point past the end, the last variant with weight takes it
+	for i := len(s.variants) - 1; ; i-- {
+		if s.variants[i].Weight > 0 {
+			return s.variants[i], false
+		}
+	}
+}
+
+// override returns the variant named by the header or the cookie of the request, empty if none
+func (s *Splitter) override(r *http.Request) string {
+	if s.opts.Header != "" {
+		if name := r.Header.Get(s.opts.Header); name != "" {
+			return name
+		}
+	}
+	if s.opts.Cookie != "" {
+		if cookie, err := r.Cookie(s.opts.Cookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// bucket returns the point in [0, 1) of the request, the same client key always has the same point
+func (s *Splitter) bucket(r *http.Request) float64 {
+	if s.opts.Key == nil {
+		return rand.Float64()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s.opts.Key(r)))
+	return float64(h.Sum32()%10000) / 10000
+}
+
+// SetWeights changes the weights of the named variants, the other variants keep theirs
+func (s *Splitter) SetWeights(weights map[string]float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	variants := append([]Variant{}, s.variants...)
+	for name, weight := range weights {
+		found := false
+		for i := range variants {
+			if variants[i].Name == name {
+				variants[i].Weight = weight
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown variant %s in split %s", name, s.name)
+		}
+	}
+	if err := checkWeights(variants); err != nil {
+		return err
+	}
+	s.variants = variants
+	log.Printf("split %s weights set to %v", s.name, weights)
+	return nil
+}
+
+// Stats returns the weight and the requests of every variant keyed by their names
+func (s *Splitter) Stats() map[string]VariantStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := map[string]VariantStats{}
+	for _, v := range s.variants {
+		vs := *s.stats[v.Name]
+		vs.Weight = v.Weight
+		stats[v.Name] = vs
+	}
+	return stats
+}
+
+func (s *Splitter) count(name string, forced bool, failed bool, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vs := s.stats[name]
+	vs.Requests++
+	if forced {
+		vs.Forced++
+	}
+	if failed {
+		vs.Errors++
+	}
+	vs.TotalLatency += latency
+}
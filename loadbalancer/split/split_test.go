@@ -0,0 +1,200 @@
+package split
+
+import (
+	"app/loadbalancer/middleware"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// variantHandler responds the variant name in the body with the status
+func variantHandler(name string, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, name)
+	})
+}
+
+func TestSplitterVariantOf(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewSplitter("variant-of", []Variant{
+		{Name: "stable", Handler: variantHandler("stable", http.StatusOK), Weight: 95},
+		{Name: "canary", Handler: variantHandler("canary", http.StatusOK), Weight: 5},
+	}, Options{Header: "X-Variant", Cookie: "variant", Key: middleware.ClientIP})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		header    string
+		cookie    string
+		expName   string
+		expForced bool
+	}{
+		{
+			name:      "header forces the variant",
+			header:    "canary",
+			expName:   "canary",
+			expForced: true,
+		},
+		{
+			name:      "cookie forces the variant",
+			cookie:    "canary",
+			expName:   "canary",
+			expForced: true,
+		},
+		{
+			name:      "header takes precedence over the cookie",
+			header:    "stable",
+			cookie:    "canary",
+			expName:   "stable",
+			expForced: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Variant", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "variant", Value: tt.cookie})
+			}
+			variant, forced := s.variantOf(r)
+			assert.Equal(t, tt.expName, variant.Name)
+			assert.Equal(t, tt.expForced, forced)
+		})
+	}
+}
+
+func TestSplitterStickyWeights(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewSplitter("sticky", []Variant{
+		{Name: "stable", Handler: variantHandler("stable", http.StatusOK), Weight: 95},
+		{Name: "canary", Handler: variantHandler("canary", http.StatusOK), Weight: 5},
+	}, Options{Key: middleware.ClientIP})
+	assert.NoError(t, err)
+
+	assign := func() map[string]string {
+		assigned := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+			r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+			variant, _ := s.variantOf(r)
+			assigned[r.RemoteAddr] = variant.Name
+		}
+		return assigned
+	}
+	count := func(assigned map[string]string, name string) int {
+		n := 0
+		for _, v := range assigned {
+			if v == name {
+				n++
+			}
+		}
+		return n
+	}
+
+	before := assign()
+	assert.Equal(t, before, assign(), "the same client keeps its variant")
+	assert.InDelta(t, 100, count(before, "canary"), 40)
+
+	assert.NoError(t, s.SetWeights(map[string]float64{"stable": 80, "canary": 20}))
+	after := assign()
+	assert.InDelta(t, 400, count(after, "canary"), 80)
+	for client, name := range before {
+		if name == "canary" {
+			assert.Equal(t, "canary", after[client], "the canary clients stay when its weight is raised")
+		}
+	}
+}
+
+func TestSplitterSetWeights(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewSplitter("set-weights", []Variant{
+		{Name: "stable", Weight: 100},
+		{Name: "canary", Weight: 0},
+	}, Options{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		weights    map[string]float64
+		expErr     bool
+		expWeights map[string]float64
+	}{
+		{
+			name:       "raise canary",
+			weights:    map[string]float64{"canary": 10},
+			expWeights: map[string]float64{"stable": 100, "canary": 10},
+		},
+		{
+			name:       "unknown variant",
+			weights:    map[string]float64{"blue": 10},
+			expErr:     true,
+			expWeights: map[string]float64{"stable": 100, "canary": 10},
+		},
+		{
+			name:       "all weights 0",
+			weights:    map[string]float64{"stable": 0, "canary": 0},
+			expErr:     true,
+			expWeights: map[string]float64{"stable": 100, "canary": 10},
+		},
+		{
+			name:       "negative weight",
+			weights:    map[string]float64{"canary": -1},
+			expErr:     true,
+			expWeights: map[string]float64{"stable": 100, "canary": 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.SetWeights(tt.weights)
+			if tt.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			for name, weight := range tt.expWeights {
+				assert.Equal(t, weight, s.Stats()[name].Weight)
+			}
+		})
+	}
+}
+
+func TestSplitterServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	observed := map[string]int{}
+	observe := func(variant string, failed bool, latency time.Duration) { observed[variant]++ }
+	s, err := NewSplitter("serve-http", []Variant{
+		{Name: "stable", Handler: variantHandler("stable", http.StatusOK), Weight: 1},
+		{Name: "canary", Handler: variantHandler("canary", http.StatusBadGateway), Weight: 0},
+	}, Options{Header: "X-Variant", Observe: observe})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", nil))
+		assert.Equal(t, "stable", w.Body.String())
+	}
+	r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+	r.Header.Set("X-Variant", "canary")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	stats := s.Stats()
+	assert.Equal(t, int64(3), stats["stable"].Requests)
+	assert.Equal(t, VariantStats{Requests: 1, Forced: 1, Errors: 1, TotalLatency: stats["canary"].TotalLatency}, stats["canary"])
+	// the forced requests are not observed
+	assert.Equal(t, map[string]int{"stable": 3}, observed)
+}
@@ -0,0 +1,335 @@
+package tcpproxy
+
+import (
+	"app/loadbalancer/balancer"
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tcpMetrics publishes the Stats of every TCP proxy at /debug/vars
+var tcpMetrics = expvar.NewMap("tcpProxies")
+
+// ErrProxyClosed is returned by Serve after Shutdown
+var ErrProxyClosed = errors.New("tcpproxy: proxy closed")
+
+// maxAcceptDelay caps the backoff between the retries of failed accepts
+const maxAcceptDelay = time.Second
+
+// Picker picks and acquires the instance of a connection, e.g., balancer.RoundRobin or balancer.WeightedRoundRobin.
+// release is called with whether the instance was dialed and the dial latency.
+type Picker interface {
+	Pick(ctx context.Context) (instance balancer.RRInstance, release func(success bool, latency time.Duration), err error)
+}
+
+// Options holds the timeouts of the proxied connections
+type Options struct {
+	// IdleTimeout closes a connection when no byte is read in either direction for this long, default 5m
+	IdleTimeout time.Duration
+	// DialTimeout bounds picking an instance, including the wait in the queue, and dialing it, default 10s
+	DialTimeout time.Duration
+}
+
+// Stats is a snapshot of the connections of a proxy
+type Stats struct {
+	// Accepted counts the client connections, Failed the ones closed without an instance picked or dialed
+	Accepted int64 `json:"accepted"`
+	Failed   int64 `json:"failed"`
+	// IdleTimeouts counts the connections closed by the idle timeout
+	IdleTimeouts int64 `json:"idleTimeouts"`
+	Active       int64 `json:"active"`
+	// BytesIn and BytesOut are the bytes sent by the clients and by the instances
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+}
+
+// Proxy accepts raw TCP connections and pipes each of them to an instance picked by the balancer
+type Proxy struct {
+	picker Picker
+	opts   Options
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	// conns maps the client connections to their upstream connection, nil until it's dialed
+	conns  map[net.Conn]net.Conn
+	closed bool
+	wg     sync.WaitGroup
+
+	accepted, failed, idleTimeouts, bytesIn, bytesOut int64
+}
+
+// NewProxy new a Proxy sending the connections to the instances picked by picker, its stats are published under its name
+func NewProxy(name string, picker Picker, opts Options) *Proxy {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 5 * time.Minute
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 10 * time.Second
+	}
+	p := &Proxy{
+		picker:    picker,
+		opts:      opts,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]net.Conn{},
+	}
+	tcpMetrics.Set(name, expvar.Func(func() interface{} {
+		return p.Stats()
+	}))
+	return p
+}
+
+// Serve accepts the connections of l until Shutdown or l is closed, it always returns a non-nil error
+func (p *Proxy) Serve(l net.Listener) error {
+	if !p.track(l, true) {
+		l.Close()
+		return ErrProxyClosed
+	}
+	defer p.track(l, false)
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return ErrProxyClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// the other errors, e.g., running out of file descriptors, are retried with a capped backoff like http.Server does
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Printf("failed to accept a connection with error: %s, retrying in %s\n", err.Error(), delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		atomic.AddInt64(&p.accepted, 1)
+		if !p.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer p.trackConn(conn, false)
+			p.handle(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for the ones in flight to end until ctx is done,
+// the remaining connections are then closed
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	for l := range p.listeners {
+		l.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		for client, upstream := range p.conns {
+			client.Close()
+			if upstream != nil {
+				upstream.Close()
+			}
+		}
+		p.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Stats returns a snapshot of the connections
+func (p *Proxy) Stats() Stats {
+	p.mu.Lock()
+	active := int64(len(p.conns))
+	p.mu.Unlock()
+	return Stats{
+		Accepted:     atomic.LoadInt64(&p.accepted),
+		Failed:       atomic.LoadInt64(&p.failed),
+		IdleTimeouts: atomic.LoadInt64(&p.idleTimeouts),
+		Active:       active,
+		BytesIn:      atomic.LoadInt64(&p.bytesIn),
+		BytesOut:     atomic.LoadInt64(&p.bytesOut),
+	}
+}
+
+// handle picks an instance for the client connection and pipes the bytes both ways until either side closes or idles.
+// The instance is acquired for the whole connection, so it counts toward its max connections.
+func (p *Proxy) handle(client net.Conn) {
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.DialTimeout)
+	defer cancel()
+	instance, release, err := p.picker.Pick(ctx)
+	if err != nil {
+		atomic.AddInt64(&p.failed, 1)
+		log.Printf("failed to acquire an instance for %s with error: %s\n", client.RemoteAddr(), err.Error())
+		return
+	}
+	startTime := time.Now()
+	var dialer net.Dialer
+	upstream, err := dialer.DialContext(ctx, "tcp", instance.Addr())
+	latency := time.Since(startTime)
+	if err != nil {
+		release(false, latency)
+		atomic.AddInt64(&p.failed, 1)
+		log.Printf("failed to connect to %s with error: %s\n", instance.Addr(), err.Error())
+		return
+	}
+	defer release(true, latency)
+	defer upstream.Close()
+	p.setUpstream(client, upstream)
+
+	idle := &idleTracker{timeout: p.opts.IdleTimeout}
+	idle.touch()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.pipe(upstream, client, idle, &p.bytesIn)
+	}()
+	go func() {
+		defer wg.Done()
+		p.pipe(client, upstream, idle, &p.bytesOut)
+	}()
+	wg.Wait()
+	if idle.timedOut() {
+		atomic.AddInt64(&p.idleTimeouts, 1)
+	}
+}
+
+// pipe copies src to dst until src is closed, the write side of dst is then closed so the peer sees the EOF.
+// A read deadline is hit only when neither direction has moved a byte for the idle timeout,
+// in which case or on any other error both connections are closed.
+func (p *Proxy) pipe(dst, src net.Conn, idle *idleTracker, bytes *int64) {
+	buf := make([]byte, 32*1024)
+	for {
+		src.SetReadDeadline(idle.deadline())
+		n, err := src.Read(buf)
+		if n > 0 {
+			idle.touch()
+			dst.SetWriteDeadline(idle.deadline())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				src.Close()
+				dst.Close()
+				return
+			}
+			atomic.AddInt64(bytes, int64(n))
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			} else {
+				dst.Close()
+			}
+			return
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() && !idle.expired() {
+			// the other direction is still active
+			continue
+		}
+		if errors.As(err, &ne) && ne.Timeout() {
+			idle.expire()
+		}
+		src.Close()
+		dst.Close()
+		return
+	}
+}
+
+func (p *Proxy) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// track adds or removes a listener, a listener is not added once the proxy is closed
+func (p *Proxy) track(l net.Listener, add bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !add {
+		delete(p.listeners, l)
+		return true
+	}
+	if p.closed {
+		return false
+	}
+	p.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes a client connection Shutdown waits for, a connection is not added once the proxy is closed
+func (p *Proxy) trackConn(conn net.Conn, add bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !add {
+		delete(p.conns, conn)
+		p.wg.Done()
+		return true
+	}
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = nil
+	p.wg.Add(1)
+	return true
+}
+
+// setUpstream records the upstream connection of a client connection, so a forced Shutdown closes both
+func (p *Proxy) setUpstream(client, upstream net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.conns[client]; ok {
+		p.conns[client] = upstream
+	}
+}
+
+// idleTracker holds the last time a byte was read in either direction of a connection
+type idleTracker struct {
+	timeout time.Duration
+	// last is the UnixNano of the last read, idled is set once the connection is closed for idling
+	last  int64
+	idled int32
+}
+
+func (t *idleTracker) touch() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+func (t *idleTracker) deadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.last)).Add(t.timeout)
+}
+
+func (t *idleTracker) expired() bool {
+	return !time.Now().Before(t.deadline())
+}
+
+func (t *idleTracker) expire() {
+	atomic.StoreInt32(&t.idled, 1)
+}
+
+func (t *idleTracker) timedOut() bool {
+	return atomic.LoadInt32(&t.idled) == 1
+}
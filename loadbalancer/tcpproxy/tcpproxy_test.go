@@ -0,0 +1,221 @@
+package tcpproxy
+
+import (
+	"app/loadbalancer/balancer"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newEchoServer starts a TCP server writing back what it reads, the write side is closed at EOF
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	return l
+}
+
+// startProxy serves a proxy of the urls on a random port, it's shut down at the end of the test
+func startProxy(t *testing.T, name string, urls []string, opts Options) (*Proxy, *balancer.RoundRobin, string) {
+	rr, err := balancer.NewRoundRobin(urls, 5, balancer.WithName(name))
+	assert.NoError(t, err)
+	p := NewProxy(name, rr, opts)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go p.Serve(l)
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+	return p, rr, l.Addr().String()
+}
+
+func TestProxyPipe(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	tests := []struct {
+		name   string
+		writes []string
+		exp    string
+	}{
+		{
+			name:   "one write",
+			writes: []string{"PING\r\n"},
+			exp:    "PING\r\n",
+		},
+		{
+			name:   "several writes",
+			writes: []string{"SET k v\r\n", "GET k\r\n"},
+			exp:    "SET k v\r\nGET k\r\n",
+		},
+		{
+			name:   "nothing written",
+			writes: nil,
+			exp:    "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, rr, addr := startProxy(t, "pipe-"+tt.name, []string{"tcp://" + echo.Addr().String()}, Options{})
+
+			conn, err := net.Dial("tcp", addr)
+			assert.NoError(t, err)
+			defer conn.Close()
+			for _, w := range tt.writes {
+				_, err := conn.Write([]byte(w))
+				assert.NoError(t, err)
+			}
+			// the half-close reaches the echo server, which then ends the response
+			conn.(*net.TCPConn).CloseWrite()
+			b, err := io.ReadAll(conn)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.exp, string(b))
+
+			// the connection counts toward the load of the instance until it's closed
+			assert.Eventually(t, func() bool {
+				return rr.Stats().Instances[0].InFlight == 0 && p.Stats().Active == 0
+			}, time.Second, 10*time.Millisecond)
+			stats := p.Stats()
+			assert.Equal(t, int64(1), stats.Accepted)
+			assert.Equal(t, int64(len(tt.exp)), stats.BytesIn)
+			assert.Equal(t, int64(len(tt.exp)), stats.BytesOut)
+		})
+	}
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+	p, _, addr := startProxy(t, "idle", []string{"tcp://" + echo.Addr().String()}, Options{IdleTimeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	// the traffic within the idle timeout keeps the connection open
+	buf := make([]byte, 2)
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		conn.Write([]byte("hi"))
+		_, err := io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(buf)
+	assert.True(t, errors.Is(err, io.EOF))
+	assert.Eventually(t, func() bool {
+		return p.Stats().IdleTimeouts == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestProxySkipsDeadInstance(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	dead.Close()
+	_, rr, addr := startProxy(t, "dead", []string{"tcp://" + dead.Addr().String(), "tcp://" + echo.Addr().String()}, Options{})
+	// the TCP probe marks the closed port dead
+	rr.HealthCheck()
+
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		conn.Write([]byte("hi"))
+		conn.(*net.TCPConn).CloseWrite()
+		b, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "hi", string(b))
+		conn.Close()
+	}
+}
+
+func TestProxyShutdown(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+	p, _, addr := startProxy(t, "shutdown", []string{"tcp://" + echo.Addr().String()}, Options{})
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("hi"))
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	assert.NoError(t, err)
+
+	// the open connection is closed once the shutdown times out, and no connection is accepted anymore
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(p.Shutdown(ctx), context.DeadlineExceeded))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+// flakyListener fails the first accepts with a temporary error
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestProxyServeRetriesAccept(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+	rr, err := balancer.NewRoundRobin([]string{"tcp://" + echo.Addr().String()}, 5, balancer.WithName("flaky"))
+	assert.NoError(t, err)
+	p := NewProxy("flaky", rr, Options{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(&flakyListener{Listener: l, failures: 3}) }()
+
+	// the connection is accepted once the errors stop
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("hi"))
+	conn.(*net.TCPConn).CloseWrite()
+	b, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(b))
+
+	// only closing the listener ends Serve
+	l.Close()
+	assert.ErrorIs(t, <-served, net.ErrClosed)
+	p.Shutdown(context.Background())
+}